@@ -3,15 +3,22 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
 	"io"
 	"io/fs"
 	"log"
 	"math/big"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
@@ -21,8 +28,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/shlex"
 	"github.com/jstrieb/killfam"
@@ -34,11 +44,291 @@ import (
 
 var logger *log.Logger
 var noPause, randomPort bool
-var logfileName, wd string
+var logfileName, wd, configName string
+var rootDir string
+var config Config
+
+// Rooted path of the configuration file in use, if it is in the folder being
+// served. It is never served, since it may have private settings.
+var configPath string
+
+// Methods that executable routes respond to. This is used to answer OPTIONS
+// requests without running anything.
+var executableMethods = []string{"OPTIONS", "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
 
 //go:embed favicon.ico
 var embedFS embed.FS
 
+// Page for folders that don't have an index file. Sorting is done using the
+// sort and order query parameters.
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"size": FormatSize,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Index of {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.25em 1em; text-align: left; }
+td.size { text-align: right; }
+tr:nth-child(even) { background: #f2f2f2; }
+.run { font-size: 0.75em; color: white; background: #286; border-radius: 0.25em; padding: 0 0.4em; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr>{{range .Columns}}<th><a href="{{.Link}}">{{.Label}}</a> {{.Arrow}}</th>{{end}}</tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr>
+<td><a href="{{.Link}}">{{.Name}}{{if .IsDir}}/{{end}}</a>{{if .Executable}} <span class="run" title="Runs when visited">run</span>{{end}}</td>
+<td class="size">{{if not .IsDir}}{{size .Size}}{{end}}</td>
+<td>{{.Modified.Format "2006-01-02 15:04"}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Types for common file extensions. The MIME type databases of different
+// operating systems disagree, and some have missing or wrong types (like
+// text/plain for .js files), so these are used instead to send files with the
+// same types everywhere. Users can add more in the configuration file.
+var extensionTypes = map[string]string{
+	// Web pages and code
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".wasm":        "application/wasm",
+	".xml":         "application/xml",
+
+	// Text and documents
+	".txt": "text/plain; charset=utf-8",
+	".csv": "text/csv; charset=utf-8",
+	".md":  "text/markdown; charset=utf-8",
+	".vtt": "text/vtt; charset=utf-8",
+	".pdf": "application/pdf",
+
+	// Images
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".gif":  "image/gif",
+	".ico":  "image/vnd.microsoft.icon",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".webp": "image/webp",
+
+	// Fonts
+	".otf":   "font/otf",
+	".ttf":   "font/ttf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+
+	// Audio and video, including HLS streams
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4a":  "audio/mp4",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".ogg":  "audio/ogg",
+	".ts":   "video/mp2t",
+	".wav":  "audio/wav",
+	".webm": "video/webm",
+
+	// Archives
+	".zip": "application/zip",
+}
+
+// Headers added to every response by the basic security header preset.
+var basicSecurityHeaders = map[string]string{
+	"Content-Security-Policy": "base-uri 'self'; frame-ancestors 'self'; object-src 'none'",
+	"Referrer-Policy":         "strict-origin-when-cross-origin",
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "SAMEORIGIN",
+}
+
+// Headers added to every response by each security header preset. The
+// isolated preset adds the same headers, and also turns on cross-origin
+// isolation.
+var securityHeaderPresets = map[string]map[string]string{
+	"basic":    basicSecurityHeaders,
+	"isolated": basicSecurityHeaders,
+}
+
+// Rules from .quickservignore files, keyed by the folder they are in. Rules are
+// read again if the file changes.
+var ignoreCache = struct {
+	sync.Mutex
+	files map[string]ignoreFile
+}{files: make(map[string]ignoreFile)}
+
+// Program output saved for identical requests, keyed by a hash of the request
+var outputCache = struct {
+	sync.Mutex
+	entries map[string]Output
+}{entries: make(map[string]Output)}
+
+// Param is a value captured from the request path by a bracketed file or
+// folder name such as [id] or [...rest].
+type Param struct {
+	Name, Value string
+}
+
+// Config holds settings that can be changed using command line flags, or in a
+// JSON configuration file. Flags take priority over the configuration file.
+type Config struct {
+	NoHeadExec  bool     `json:"no_head_exec"`
+	SaveUploads bool     `json:"save_uploads"`
+	MaxUploadMB int64    `json:"max_upload_mb"`
+	JSONArgs    bool     `json:"json_args"`
+	ArgStyle    string   `json:"arg_style"`
+	MaxBodyMB   int64    `json:"max_body_mb"`
+	BodyTimeout Duration `json:"body_timeout"`
+
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	MaxHeaderBytes    int      `json:"max_header_bytes"`
+
+	Compress         bool `json:"compress"`
+	CompressMinBytes int  `json:"compress_min_bytes"`
+
+	CacheTTL     Duration `json:"cache_ttl"`
+	CacheControl string   `json:"cache_control"`
+
+	MimeTypes map[string]string `json:"mime_types"`
+
+	SecurityHeaders     string `json:"security_headers"`
+	CrossOriginIsolated bool   `json:"cross_origin_isolated"`
+
+	SPA bool `json:"spa"`
+
+	CleanURLs          bool     `json:"clean_urls"`
+	CleanURLRedirect   bool     `json:"clean_url_redirect"`
+	CleanURLExtensions []string `json:"clean_url_extensions"`
+
+	NoListing     bool   `json:"no_listing"`
+	AllowDotfiles bool   `json:"allow_dotfiles"`
+	Symlinks      string `json:"symlinks"`
+
+	Routes []RouteConfig `json:"routes"`
+}
+
+// RouteConfig holds settings from the configuration file that only apply to
+// some paths. The path is a pattern like those used by path.Match, except that
+// a pattern ending in "/**" matches everything inside of a folder. Empty
+// settings are inherited from the global settings.
+type RouteConfig struct {
+	Path         string            `json:"path"`
+	ArgStyle     string            `json:"arg_style"`
+	MaxBodyMB    *int64            `json:"max_body_mb"`
+	ContentType  string            `json:"content_type"`
+	CacheTTL     *Duration         `json:"cache_ttl"`
+	CacheControl string            `json:"cache_control"`
+	Headers      map[string]string `json:"headers"`
+}
+
+// Duration is a time.Duration that is written like "30s" or "1m30s" in both the
+// configuration file and command line flags.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"30s\": %v", err)
+	}
+	return d.Set(s)
+}
+
+// Styles for passing form variables to executed programs as arguments
+const (
+	ArgStyleGNU        = "gnu"
+	ArgStyleKeyValue   = "key-value"
+	ArgStylePositional = "positional"
+	ArgStyleEnv        = "env"
+	ArgStyleJSON       = "json"
+)
+
+// Policies for symbolic links in the folder being served
+const (
+	SymlinksFollow     = "follow"
+	SymlinksWithinRoot = "follow-within-root"
+	SymlinksDeny       = "deny"
+)
+
+// FormField is one variable from a form. Forms are kept as lists of fields,
+// rather than as url.Values maps, so that their order is preserved.
+type FormField struct {
+	Name, Value string
+}
+
+// Route is an executable file that handles a request, along with any values
+// captured from the request path to reach it. PathInfo is the part of the
+// request path after the executable file, if any, as in CGI. Status is the
+// error status code that the route is a custom error page for, if any.
+type Route struct {
+	Path     string
+	Params   []Param
+	PathInfo string
+	Status   int
+}
+
+// ListingEntry is a file or folder in a directory listing. Executable entries
+// are run when visited, instead of being sent as-is.
+type ListingEntry struct {
+	Name       string    `json:"name"`
+	Link       string    `json:"-"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+	IsDir      bool      `json:"is_dir"`
+	Executable bool      `json:"executable"`
+}
+
+// IgnoreRule is a pattern from a .quickservignore file, converted to a regular
+// expression that matches paths relative to the folder the file is in.
+type IgnoreRule struct {
+	Pattern *regexp.Regexp
+	Negate  bool
+	DirOnly bool
+}
+
+type ignoreFile struct {
+	modTime time.Time
+	rules   []IgnoreRule
+}
+
+// Output is information about the response from running a program, such as
+// its content type, and whether that type was declared rather than guessed.
+// The response itself is only kept in Body if it is cached, and Expires is when
+// it can no longer be reused.
+type Output struct {
+	Body        []byte
+	ETag        string
+	ContentType string
+	Declared    bool
+	Expires     time.Time
+}
+
 /******************************************************************************
  * Helper Functions
  *****************************************************************************/
@@ -97,6 +387,161 @@ func Fatal(s interface{}) {
 	os.Exit(1)
 }
 
+// LoadConfig reads settings from the JSON configuration file into the global
+// configuration, and then re-applies any command line flags so that they take
+// priority. If the file doesn't exist and the user didn't ask for it
+// specifically, the defaults are used.
+func LoadConfig(filename string, required bool) error {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("Using configuration file:\n%v\n\n", filename)
+	if abs, err := filepath.Abs(filename); err == nil {
+		if rel, err := filepath.Rel(rootDir, abs); err == nil && rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			configPath = "/" + filepath.ToSlash(rel)
+		}
+	}
+
+	flags := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("couldn't read configuration file %v: %v", filename, err)
+	}
+	for name, value := range flags {
+		if err := flag.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckConfig returns an error if any settings have invalid values.
+func CheckConfig(c Config) error {
+	checkArgStyle := func(style string) error {
+		switch style {
+		case "", ArgStyleGNU, ArgStyleKeyValue, ArgStylePositional, ArgStyleEnv, ArgStyleJSON:
+			return nil
+		}
+		return fmt.Errorf("unknown argument style %q", style)
+	}
+
+	if err := checkArgStyle(c.ArgStyle); err != nil {
+		return err
+	}
+	switch c.Symlinks {
+	case SymlinksFollow, SymlinksWithinRoot, SymlinksDeny:
+	default:
+		return fmt.Errorf("unknown symbolic link policy %q", c.Symlinks)
+	}
+	if _, ok := securityHeaderPresets[c.SecurityHeaders]; c.SecurityHeaders != "" && !ok {
+		return fmt.Errorf("unknown security header preset %q", c.SecurityHeaders)
+	}
+	for _, ext := range c.CleanURLExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("clean URL file extension %q must start with a dot", ext)
+		}
+	}
+	for ext, contentType := range c.MimeTypes {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("file extension %q for MIME type must start with a dot", ext)
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("bad MIME type %q for %v: %v", contentType, ext, err)
+		}
+	}
+	for _, route := range c.Routes {
+		if _, err := path.Match(route.Path, "/"); err != nil {
+			return fmt.Errorf("bad route path %q: %v", route.Path, err)
+		}
+		if err := checkArgStyle(route.ArgStyle); err != nil {
+			return err
+		}
+		for name := range route.Headers {
+			if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+				return fmt.Errorf("bad header name %q for route %q", name, route.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// MatchPath returns whether the rooted path matches the pattern. Patterns are
+// the same as path.Match, except that a pattern ending in "/**" matches
+// everything inside of that folder.
+func MatchPath(pattern, p string) bool {
+	if prefix := strings.TrimSuffix(pattern, "**"); prefix != pattern &&
+		strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(p+"/", prefix)
+	}
+	matched, _ := path.Match(pattern, p)
+	return matched
+}
+
+// SettingsFor returns the settings that apply to any of the input paths, which
+// are the global settings, overridden by settings for each matching route in
+// order.
+func SettingsFor(paths ...string) RouteConfig {
+	maxBodyMB := config.MaxBodyMB
+	cacheTTL := config.CacheTTL
+	settings := RouteConfig{
+		ArgStyle:     config.ArgStyle,
+		MaxBodyMB:    &maxBodyMB,
+		CacheTTL:     &cacheTTL,
+		CacheControl: config.CacheControl,
+		Headers:      make(map[string]string),
+	}
+	for _, route := range config.Routes {
+		matched := false
+		for _, p := range paths {
+			matched = matched || MatchPath(route.Path, p)
+		}
+		if !matched {
+			continue
+		}
+		if route.ArgStyle != "" {
+			settings.ArgStyle = route.ArgStyle
+		}
+		if route.MaxBodyMB != nil {
+			settings.MaxBodyMB = route.MaxBodyMB
+		}
+		if route.ContentType != "" {
+			settings.ContentType = route.ContentType
+		}
+		if route.CacheTTL != nil {
+			settings.CacheTTL = route.CacheTTL
+		}
+		if route.CacheControl != "" {
+			settings.CacheControl = route.CacheControl
+		}
+		for name, value := range route.Headers {
+			settings.Headers[name] = value
+		}
+	}
+	return settings
+}
+
+// SetRouteHeaders sets the Cache-Control header and other headers from the
+// settings for any of the input paths. It is called again once the file or
+// route that handles a request is known, so settings for that file apply as
+// well.
+func SetRouteHeaders(w http.ResponseWriter, paths ...string) {
+	settings := SettingsFor(paths...)
+	if settings.CacheControl != "" {
+		w.Header().Set("Cache-Control", settings.CacheControl)
+	}
+	for name, value := range settings.Headers {
+		w.Header().Set(name, value)
+	}
+}
+
 // GetLocalIP finds the IP address of the computer on the local area network so
 // anyone on the same network can connect to the server. Code inspired by:
 // https://stackoverflow.com/a/37382208/1376127
@@ -123,46 +568,91 @@ func GetLocalIP() string {
 	return resultString
 }
 
-// DecodeForm performs URL query unescaping on encoded form data to make parsing
-// easier. Remaining encoded strings are:
+// DecodeForm converts form data back into its encoded form, but with URL query
+// escaping undone to make parsing easier. Remaining encoded strings are:
 //
 //	% -> %25
 //	& -> %26
 //	= -> %3D
 //
-// If "%" is not encoded first in the pre-encoding step, then it will encode the
-// percent signs from the encoding of & and = in addition to real percent signs,
-// which will give incorrect results.
-func DecodeForm(form url.Values) ([]byte, error) {
-	// Pre-encoding step where special characters are encoded before the entire
-	// form is encoded and then decoded
-	newForm := make(url.Values, len(form))
-	for k, vs := range form {
-		// Replace equals, percent, and ampersands in form variable names
+// If "%" is not encoded first, then it will encode the percent signs from the
+// encoding of & and = in addition to real percent signs, which will give
+// incorrect results. Variables are kept in the order of the input.
+func DecodeForm(form []FormField) []byte {
+	encode := func(s string) string {
 		// NOTE: "%" must be encoded first -- see above
-		newK := strings.ReplaceAll(k, "%", "%25")
-		newK = strings.ReplaceAll(newK, "&", "%26")
-		newK = strings.ReplaceAll(newK, "=", "%3D")
-		newForm[newK] = make([]string, len(form[k]))
+		s = strings.ReplaceAll(s, "%", "%25")
+		s = strings.ReplaceAll(s, "&", "%26")
+		return strings.ReplaceAll(s, "=", "%3D")
+	}
 
-		// Replace equals, percent, and ampersands in form variable values
-		// NOTE: "%" must be encoded first -- see above
-		for i, v := range vs {
-			v = strings.ReplaceAll(v, "%", "%25")
-			v = strings.ReplaceAll(v, "&", "%26")
-			v = strings.ReplaceAll(v, "=", "%3D")
-			newForm[newK][i] = v
+	pairs := make([]string, len(form))
+	for i, field := range form {
+		pairs[i] = encode(field.Name) + "=" + encode(field.Value)
+	}
+	return []byte(strings.Join(pairs, "&"))
+}
+
+// ParseQuery parses URL-encoded form data like "a=1&b=2" into a list of form
+// variables, in the same order they appear in the input.
+func ParseQuery(query string) ([]FormField, error) {
+	var form []FormField
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			name, value = pair[:i], pair[i+1:]
+		}
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err = url.QueryUnescape(value)
+		if err != nil {
+			return nil, err
 		}
+		form = append(form, FormField{name, value})
+	}
+	return form, nil
+}
+
+// ParseOrderedForm parses the variables of a form request in the order they
+// were sent. Variables from the query string come first, followed by those in
+// the request body if it is URL-encoded. Like Request.ParseForm, at most 10 MB
+// of the body is read.
+func ParseOrderedForm(r *http.Request) ([]FormField, error) {
+	form, err := ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	if r.Method == "GET" || r.Method == "HEAD" || !IsFormRequest(r) {
+		return form, nil
 	}
 
-	// Encode the form as a string and decode as almost entirely plain text
-	rawFormData := []byte(newForm.Encode())
-	formData, err := url.QueryUnescape(string(rawFormData))
+	const maxFormSize = 10 << 20
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxFormSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxFormSize {
+		return nil, errors.New("http: POST too large")
+	}
+	bodyForm, err := ParseQuery(string(body))
 	if err != nil {
 		return nil, err
 	}
+	return append(form, bodyForm...), nil
+}
 
-	return []byte(formData), nil
+// FormToValues converts an ordered form into url.Values.
+func FormToValues(form []FormField) url.Values {
+	values := make(url.Values)
+	for _, field := range form {
+		values.Add(field.Name, field.Value)
+	}
+	return values
 }
 
 // IsWSL returns whether or not the binary is running inside Windows Subsystem
@@ -191,6 +681,236 @@ func IsWSL() bool {
 	return false
 }
 
+// SafeDir is like http.Dir, except that it refuses to open paths that the
+// symbolic link policy doesn't allow. Refused paths act like they don't exist.
+type SafeDir string
+
+func (d SafeDir) Open(name string) (http.File, error) {
+	fullPath := filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name)))
+	if err := CheckSymlinks(fullPath); err != nil {
+		logger.Println(err)
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return http.Dir(d).Open(name)
+}
+
+// CheckSymlinks returns an error if the file at the path, or any folder above
+// it, is a symbolic link that isn't allowed. Depending on the policy, either
+// all links are allowed, only links to something inside of the folder being
+// served are allowed, or no links are allowed. Paths that don't exist are
+// allowed, since they can't be opened anyway.
+func CheckSymlinks(name string) error {
+	if config.Symlinks == SymlinksFollow {
+		return nil
+	}
+	abspath, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	if config.Symlinks == SymlinksDeny {
+		rel, err := filepath.Rel(rootDir, abspath)
+		if err != nil {
+			return err
+		}
+		current := rootDir
+		for _, part := range strings.Split(rel, string(filepath.Separator)) {
+			current = filepath.Join(current, part)
+			info, err := os.Lstat(current)
+			if err != nil {
+				return nil
+			} else if info.Mode()&fs.ModeSymlink != 0 {
+				return fmt.Errorf("%v is a symbolic link, and links are not allowed", current)
+			}
+		}
+		return nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(abspath)
+	if err != nil {
+		return nil
+	}
+	root, err := filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%v links outside of the folder being served", name)
+	}
+	return nil
+}
+
+// IsHiddenName returns whether files and folders with the name are hidden from
+// users. Names starting with a dot are hidden unless the user allows them,
+// since they are often private, like .env files, .ssh keys, and version control
+// folders such as .git. The .well-known folder is an exception, since it is
+// used for standard URLs like /.well-known/security.txt.
+func IsHiddenName(name string) bool {
+	return !config.AllowDotfiles && strings.HasPrefix(name, ".") &&
+		name != "." && name != ".." && name != ".well-known"
+}
+
+// IsHiddenPath returns whether any file or folder in the path is hidden.
+//
+// NOTE: The input path is expected to use forward slashes
+func IsHiddenPath(p string) bool {
+	for _, name := range strings.Split(p, "/") {
+		if IsHiddenName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// IgnorePatternToRegexp converts a .quickservignore pattern into a regular
+// expression. Patterns use the same syntax as .gitignore files: "*" matches
+// anything except a slash, "?" matches one character, "[a-z]" matches a range,
+// and "**" matches any number of folders. Patterns that aren't anchored match
+// at any depth.
+func IgnorePatternToRegexp(pattern string, anchored bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[' && strings.Contains(pattern[i+1:], "]"):
+			end := i + 1 + strings.Index(pattern[i+1:], "]")
+			class := pattern[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i = end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// ParseIgnoreFile reads the rules in a .quickservignore file. Like .gitignore
+// files, blank lines and lines starting with "#" are skipped, patterns starting
+// with "!" un-ignore paths, patterns ending with "/" only match folders, and
+// patterns with a "/" anywhere else are relative to the folder with the file.
+func ParseIgnoreFile(data []byte) []IgnoreRule {
+	var rules []IgnoreRule
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule IgnoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.Negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.DirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+
+		pattern, err := IgnorePatternToRegexp(line, anchored)
+		if err != nil {
+			logger.Println(err)
+			logger.Printf("Skipping bad ignore pattern %q.\n", line)
+			continue
+		}
+		rule.Pattern = pattern
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// GetIgnoreRules returns the rules from the .quickservignore file in the
+// folder, if there is one.
+//
+// NOTE: The input dir is expected to be a rooted path with forward slashes
+func GetIgnoreRules(dir string) []IgnoreRule {
+	f, err := SafeDir(".").Open(path.Join(dir, ".quickservignore"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil || d.IsDir() {
+		return nil
+	}
+
+	ignoreCache.Lock()
+	defer ignoreCache.Unlock()
+	if cached, ok := ignoreCache.files[dir]; ok && cached.modTime.Equal(d.ModTime()) {
+		return cached.rules
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		logger.Println(err)
+		return nil
+	}
+	rules := ParseIgnoreFile(data)
+	ignoreCache.files[dir] = ignoreFile{d.ModTime(), rules}
+	return rules
+}
+
+// IsIgnoredPath returns whether the path is ignored by the rules in
+// .quickservignore files in any of the folders above it. Rules in deeper
+// folders take priority, as do later rules in the same file. Like with Git,
+// everything in an ignored folder is ignored. The configuration file in use is
+// always ignored.
+//
+// NOTE: The input path is expected to be rooted with forward slashes
+func IsIgnoredPath(p string, isDir bool) bool {
+	if configPath != "" && path.Clean(p) == configPath {
+		return true
+	}
+	segments := strings.Split(strings.Trim(path.Clean(p), "/"), "/")
+	if segments[0] == "" {
+		return false
+	}
+
+	rules := make([][]IgnoreRule, len(segments))
+	for i := range segments {
+		rules[i] = GetIgnoreRules("/" + path.Join(segments[:i]...))
+	}
+	for end := 1; end <= len(segments); end++ {
+		ignored := false
+		for i := 0; i < end; i++ {
+			rel := path.Join(segments[i:end]...)
+			for _, rule := range rules[i] {
+				if (!rule.DirOnly || isDir || end < len(segments)) && rule.Pattern.MatchString(rel) {
+					ignored = !rule.Negate
+				}
+			}
+		}
+		if ignored {
+			return true
+		}
+	}
+	return false
+}
+
 // ChangeDirIfMacOS changes the working directory to the location of the
 // QuickServ executable. This happens only on MacOS if the executable is running
 // in the user's home directory, when the executable was called using an
@@ -235,7 +955,7 @@ func ChangeDirIfMacOS(dirFlag string) {
 // GetShebang returns the shebang of the input path if possible. If there is no
 // shebang, or if the input path is invalid, the empty string is returned.
 func GetShebang(path string) string {
-	f, err := http.Dir(".").Open(path)
+	f, err := SafeDir(".").Open(path)
 	if err != nil {
 		logger.Println(err)
 		logger.Printf("Can't open file %v to get get first line.\n", path)
@@ -275,77 +995,456 @@ func GetShebang(path string) string {
 //
 // become the following. Multi-character names are preceded by two dashes "--"
 // while single-character names are preceded by one dash "-". Names with no
-// value are passed literally with no preceding dashes.
+// value are passed literally with no preceding dashes. Values with no name are
+// passed literally on their own.
 //
 //	[]string{"--name", "value", "-n", "val", "noval"}
 //
-// No guarantees are made about the order of the variables in the resulting
-// slice, except that every name directly precedes its respective value.
-func GetFormAsArguments(form url.Values) []string {
+// The arguments are in the same order as the variables in the form, and every
+// name directly precedes its respective value.
+//
+// Dashes at the start of names are removed, so "--name=value" is treated the
+// same as "name=value", and a variable named "-rf" with no value is passed as
+// "rf". Values with no name that start with a dash are skipped. This way, a
+// form can't pass options to the program that aren't preceded by the usual
+// dashes.
+func GetFormAsArguments(form []FormField) []string {
 	var result []string
-	for k, vs := range form {
-		if k != "" {
-			for _, v := range vs {
-				if v != "" {
-					switch len(k) {
-					case 1:
-						result = append(result, "-"+k, v)
-					default:
-						result = append(result, "--"+k, v)
-					}
-				} else {
-					result = append(result, k)
-				}
-			}
-		} else {
-			result = append(result, vs...)
+	for _, field := range form {
+		k, v := strings.TrimLeft(field.Name, "-"), field.Value
+		if k == "" && (field.Name != "" || strings.HasPrefix(v, "-")) {
+			// The name was only dashes, or the value would look like an
+			// option
+			continue
+		}
+		switch {
+		case k == "":
+			result = append(result, v)
+		case v == "":
+			result = append(result, k)
+		case len(k) == 1:
+			result = append(result, "-"+k, v)
+		default:
+			result = append(result, "--"+k, v)
 		}
 	}
 	return result
 }
 
-// IsPathExecutable returns whether or not a given file is executable based on
-// its file extension and permission bits (depending on the operating system),
-// and/or its shebang-style first line (irrespective of operating system).
+// GetArguments converts a parsed form into arguments in the input style. The
+// GNU style is described in GetFormAsArguments. The other styles are:
 //
-// On Windows, a file is executable if it has a file extension of "exe," "bat,"
-// or "cmd." On other operating systems, any file with the execute bit set for
-// at least one user is deemed executable.
+//	key-value:  []string{"name=value", "n=val", "noval"}
+//	positional: []string{"value", "val", ""}
 //
-// On all operating systems, if a file begins with a shebang (starting with "#!"
-// and an executable path), it is deemed executable.
+// Like in the GNU style, dashes at the start of names are removed in the
+// key-value style, and values with no name that start with a dash are skipped.
+// Positional values can't be skipped without moving the ones after them, so if
+// any of them start with a dash, they are preceded by "--", which tells most
+// programs that none of the arguments after it are options.
 //
-// NOTE: This function may not return accurate results if given a directory as
-// input. This has not been extensively tested.
-func IsPathExecutable(path string, fileinfo fs.FileInfo) bool {
-	// Check if we are in Windows Subsystem for Linux. If so, behave differently
-	// since it's Linux but we can run .exe files, and since the permission bits
-	// are all messed up such that everything will be viewed as executable.
-	goos := runtime.GOOS
-	if IsWSL() {
-		goos = "wsl"
+// In the env and json styles there are no arguments. Variables are always
+// passed as environment variables, and in the json style, they are also passed
+// as JSON on the standard input instead of the usual form data.
+func GetArguments(form []FormField, style string) []string {
+	var result []string
+	switch style {
+	case ArgStyleKeyValue:
+		for _, field := range form {
+			k, v := strings.TrimLeft(field.Name, "-"), field.Value
+			switch {
+			case k == "" && (field.Name != "" || strings.HasPrefix(v, "-")):
+				continue
+			case k == "":
+				result = append(result, v)
+			case v == "":
+				result = append(result, k)
+			default:
+				result = append(result, k+"="+v)
+			}
+		}
+	case ArgStylePositional:
+		dashes := false
+		for _, field := range form {
+			result = append(result, field.Value)
+			dashes = dashes || strings.HasPrefix(field.Value, "-")
+		}
+		if dashes {
+			result = append([]string{"--"}, result...)
+		}
+	case ArgStyleEnv, ArgStyleJSON:
+		return nil
+	default:
+		return GetFormAsArguments(form)
 	}
+	return result
+}
 
-	switch strings.ToLower(goos) {
-	case "windows":
-		// Register executable handlers based on file extension
-		switch strings.ToLower(filepath.Ext(path)) {
-		case ".exe", ".bat", ".cmd":
-			return true
+// FormToJSON encodes a form as a JSON object, keeping the variables in order.
+// Variables with multiple values are encoded as arrays.
+func FormToJSON(form []FormField) []byte {
+	values := FormToValues(form)
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for _, field := range form {
+		vs, ok := values[field.Name]
+		if !ok {
+			// Already written
+			continue
 		}
-
-	case "wsl":
-		// Register executable handlers based on file extension
-		switch strings.ToLower(filepath.Ext(path)) {
-		case ".exe":
-			return true
+		if buf.Len() > 1 {
+			buf.WriteString(",")
 		}
-
-	default:
-		// TODO: Does it make sense to look for files executable by any user?
-		filemode := fileinfo.Mode()
-		if !filemode.IsDir() && filemode.Perm()&0111 != 0 {
-			return true
+		name, _ := json.Marshal(field.Name)
+		buf.Write(name)
+		buf.WriteString(":")
+		var value []byte
+		if len(vs) == 1 {
+			value, _ = json.Marshal(vs[0])
+		} else {
+			value, _ = json.Marshal(vs)
+		}
+		buf.Write(value)
+		delete(values, field.Name)
+	}
+	buf.WriteString("}")
+	return buf.Bytes()
+}
+
+// GetEnvName replaces every character that can't safely be used in an
+// environment variable name with an underscore.
+func GetEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') ||
+			('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// GetFormAsEnv converts a parsed form into environment variables with the
+// prefix at the start of each name. Characters in names that can't be used in
+// environment variables are replaced with underscores. For example, the form:
+//
+//	name=value
+//	box=a
+//	box=b
+//
+// becomes the following when the prefix is "FORM_". Multiple values are joined
+// with commas, and are also numbered starting from zero.
+//
+//	FORM_name=value
+//	FORM_box=a,b
+//	FORM_box_0=a
+//	FORM_box_1=b
+//	FORM_box_COUNT=2
+func GetFormAsEnv(prefix string, form []FormField) []string {
+	var result []string
+	for k, vs := range FormToValues(form) {
+		name := prefix + GetEnvName(k)
+		result = append(result, name+"="+strings.Join(vs, ","))
+		if len(vs) > 1 {
+			for i, v := range vs {
+				result = append(result, name+"_"+strconv.Itoa(i)+"="+v)
+			}
+			result = append(result, name+"_COUNT="+strconv.Itoa(len(vs)))
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// IsFormRequest returns whether the request should be treated like an HTML
+// form submission. GET and HEAD requests are always treated as forms, since
+// their variables are in the query string.
+func IsFormRequest(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" ||
+		(len(r.Header["Content-Type"]) > 0 &&
+			r.Header["Content-Type"][0] == "application/x-www-form-urlencoded")
+}
+
+// IsMultipartRequest returns whether the request body is multipart form data,
+// which is how HTML forms upload files.
+func IsMultipartRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// IsJSONRequest returns whether the request body is JSON according to its
+// content type.
+func IsJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil &&
+		(mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// FlattenJSON converts the fields of a JSON object into form variables, so
+// that they can be passed to programs the same way as HTML form variables.
+// Fields of nested objects are named with dots, and arrays become variables
+// with multiple values. For example:
+//
+//	{"name": "value", "user": {"id": 1}, "tags": ["a", "b"]}
+//
+// becomes the following.
+//
+//	name=value
+//	user.id=1
+//	tags=a
+//	tags=b
+//
+// Arrays containing objects or other arrays are passed as JSON strings. A null
+// value becomes an empty string. Variables are in the same order as the fields
+// in the input.
+func FlattenJSON(data []byte) ([]FormField, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' || !json.Valid(data) {
+		return nil, errors.New("the JSON is not an object")
+	}
+
+	var form []FormField
+	var flatten func(prefix string, value json.RawMessage) error
+	flatten = func(prefix string, value json.RawMessage) error {
+		switch value[0] {
+		case '{':
+			// Decode objects one field at a time to keep them in order
+			decoder := json.NewDecoder(bytes.NewReader(value))
+			if _, err := decoder.Token(); err != nil {
+				return err
+			}
+			for decoder.More() {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				var field json.RawMessage
+				if err := decoder.Decode(&field); err != nil {
+					return err
+				}
+				name := key.(string)
+				if prefix != "" {
+					name = prefix + "." + name
+				}
+				if err := flatten(name, field); err != nil {
+					return err
+				}
+			}
+		case '[':
+			var items []json.RawMessage
+			if err := json.Unmarshal(value, &items); err != nil {
+				return err
+			}
+			for _, item := range items {
+				if item[0] == '{' || item[0] == '[' {
+					var compact bytes.Buffer
+					if err := json.Compact(&compact, value); err != nil {
+						return err
+					}
+					form = append(form, FormField{prefix, compact.String()})
+					return nil
+				}
+			}
+			for _, item := range items {
+				if err := flatten(prefix, item); err != nil {
+					return err
+				}
+			}
+		case '"':
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				return err
+			}
+			form = append(form, FormField{prefix, s})
+		case 'n':
+			form = append(form, FormField{prefix, ""})
+		default:
+			// Numbers and booleans are passed as they are written
+			form = append(form, FormField{prefix, string(value)})
+		}
+		return nil
+	}
+	if err := flatten("", data); err != nil {
+		return nil, err
+	}
+	return form, nil
+}
+
+// IsBodyTooLarge returns whether the error came from reading more of a request
+// body than allowed by http.MaxBytesReader.
+func IsBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// connKey is the context key for the connection a request was made on
+type connKey struct{}
+
+// deadlineReader wraps a request body, and gives up reading it if no data
+// arrives before the timeout. This stops clients from tying up the server by
+// sending a request body extremely slowly.
+type deadlineReader struct {
+	io.ReadCloser
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF {
+		// Once the body is done, the server may read from the connection
+		// while the program runs to see if the client disconnected, so the
+		// deadline has to be removed. If there was an error, the deadline is
+		// left so that the server doesn't wait on the rest of the body.
+		r.conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// LimitBody applies the maximum size and read timeout to the request body. If
+// the request body is already known to be too large, it returns false after
+// responding with an error.
+func LimitBody(w http.ResponseWriter, r *http.Request, maxBodyMB int64) bool {
+	if maxBodyMB > 0 {
+		if r.ContentLength > maxBodyMB<<20 {
+			logger.Printf("Request bodies can be at most %v MB.\n", maxBodyMB)
+			http.Error(w, http.StatusText(413), 413)
+			return false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyMB<<20)
+	}
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok && config.BodyTimeout > 0 {
+		r.Body = &deadlineReader{r.Body, conn, time.Duration(config.BodyTimeout)}
+	}
+	return true
+}
+
+// ExtendWriteDeadline restarts the write timeout for the connection of the
+// request. The server starts counting the write timeout when it finishes
+// reading the request headers, so without this, programs that take a long time
+// to run would use up the time meant for sending the response.
+func ExtendWriteDeadline(r *http.Request) {
+	if config.WriteTimeout <= 0 {
+		return
+	}
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(config.WriteTimeout)))
+	}
+}
+
+// ServeBodyError responds to an error reading the request body. Bodies that
+// are too large get a 413 error, bodies that are sent too slowly get a 408
+// error, and others get the input status code.
+func ServeBodyError(w http.ResponseWriter, err error, code int) {
+	var netErr net.Error
+	if IsBodyTooLarge(err) {
+		logger.Println("The request body was too large.")
+		code = 413
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		logger.Println("The request body was sent too slowly.")
+		code = 408
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+// SaveMultipartForm reads a multipart form from the request body, and saves
+// each uploaded file in its own folder inside the input directory, keeping the
+// name it was uploaded with. It returns the form variables in order, starting
+// with any in the query string. The value of each file variable is the path to
+// the saved file.
+func SaveMultipartForm(r *http.Request, dir string) ([]FormField, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form, err := ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return form, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := part.FormName()
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			form = append(form, FormField{name, string(value)})
+			continue
+		}
+
+		// Only keep the last part of the filename in case a browser sends a
+		// full path (possibly with Windows separators)
+		filename := path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+		if filename == "." || filename == ".." || filename == "/" {
+			filename = "upload"
+		}
+		fileDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(fileDir, 0700); err != nil {
+			return nil, err
+		}
+		filePath := filepath.Join(fileDir, filename)
+		f, err := os.Create(filePath)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, part)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		form = append(form, FormField{name, filePath})
+	}
+}
+
+// IsPathExecutable returns whether or not a given file is executable based on
+// its file extension and permission bits (depending on the operating system),
+// and/or its shebang-style first line (irrespective of operating system).
+//
+// On Windows, a file is executable if it has a file extension of "exe," "bat,"
+// or "cmd." On other operating systems, any file with the execute bit set for
+// at least one user is deemed executable.
+//
+// On all operating systems, if a file begins with a shebang (starting with "#!"
+// and an executable path), it is deemed executable.
+//
+// NOTE: This function may not return accurate results if given a directory as
+// input. This has not been extensively tested.
+func IsPathExecutable(path string, fileinfo fs.FileInfo) bool {
+	// Check if we are in Windows Subsystem for Linux. If so, behave differently
+	// since it's Linux but we can run .exe files, and since the permission bits
+	// are all messed up such that everything will be viewed as executable.
+	goos := runtime.GOOS
+	if IsWSL() {
+		goos = "wsl"
+	}
+
+	switch strings.ToLower(goos) {
+	case "windows":
+		// Register executable handlers based on file extension
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".exe", ".bat", ".cmd":
+			return true
+		}
+
+	case "wsl":
+		// Register executable handlers based on file extension
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".exe":
+			return true
+		}
+
+	default:
+		// TODO: Does it make sense to look for files executable by any user?
+		filemode := fileinfo.Mode()
+		if !filemode.IsDir() && filemode.Perm()&0111 != 0 {
+			return true
 		}
 	}
 
@@ -356,10 +1455,21 @@ func IsPathExecutable(path string, fileinfo fs.FileInfo) bool {
 // standard input, gets the response via standard output and writes that as the
 // response body.
 //
-// NOTE: Expects the input path to be rooted with forward slashes as the
+// Values captured from the request path are passed as both arguments and
+// environment variables. For example, [id] capturing 42 is passed as the
+// arguments "--id 42" and the environment variable PARAM_id=42. The rest of the
+// request path after the file is passed in the PATH_INFO and PATH_TRANSLATED
+// environment variables, in imitation of CGI.
+//
+// NOTE: Expects the route path to be rooted with forward slashes as the
 // separator (HTTP request style)
-func ExecutePath(ctx context.Context, execPath string, w http.ResponseWriter, r *http.Request) {
-	logger.Println("Executing:", execPath)
+func ExecutePath(ctx context.Context, route Route, w http.ResponseWriter, r *http.Request) {
+	execPath := route.Path
+	if IsHiddenPath(execPath) || IsIgnoredPath(execPath, false) {
+		logger.Printf("Not running hidden or ignored file %v\n", execPath)
+		http.NotFound(w, r)
+		return
+	}
 
 	// Clean up the path and make it un-rooted
 	if strings.HasPrefix(execPath, "/") {
@@ -372,23 +1482,107 @@ func ExecutePath(ctx context.Context, execPath string, w http.ResponseWriter, r
 		http.Error(w, http.StatusText(500), 500)
 		return
 	}
+	if err := CheckSymlinks(abspath); err != nil {
+		logger.Println(err)
+		http.NotFound(w, r)
+		return
+	}
 	dir, _ := filepath.Split(abspath)
 
-	// Get form variables as additional arguments if applicable
-	var formArguments []string
-	if r.Method == "GET" || (len(r.Header["Content-Type"]) > 0 &&
-		r.Header["Content-Type"][0] == "application/x-www-form-urlencoded") {
-		// Parse form data into r.Form
-		err = r.ParseForm()
+	// Get path parameters and form variables as additional arguments if
+	// applicable
+	settings := SettingsFor(path.Clean(r.URL.Path), route.Path)
+	if !LimitBody(w, r, *settings.MaxBodyMB) {
+		return
+	}
+
+	// Reuse the output from an identical earlier request if the user wants,
+	// and it hasn't expired. Error pages are always run.
+	var cacheKey string
+	cacheTTL := time.Duration(*settings.CacheTTL)
+	if cacheTTL > 0 && route.Status == 0 {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Println(err)
+			logger.Println("Couldn't read the request body.")
+			ServeBodyError(w, err, 500)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		cacheKey = GetCacheKey(route, r, body)
+		if output, found := GetCachedOutput(cacheKey); found {
+			logger.Println("Using saved output of:", route.Path)
+			ServeOutput(w, r, route.Status, output, bytes.NewReader(output.Body))
+			return
+		}
+	}
+	logger.Println("Executing:", route.Path)
+
+	var argFields []FormField
+	for _, param := range route.Params {
+		argFields = append(argFields, FormField{param.Name, param.Value})
+	}
+	var form []FormField
+	isForm := false
+	if IsFormRequest(r) {
+		// Parse form data in the order it was sent
+		form, err = ParseOrderedForm(r)
 		if err != nil {
 			logger.Println(err)
 			logger.Println("Couldn't parse the request form.")
+			ServeBodyError(w, err, 500)
+			return
+		}
+		isForm = true
+	} else if config.SaveUploads && IsMultipartRequest(r) {
+		// Save uploaded files in a temporary folder that is deleted once the
+		// program is done
+		uploadDir, err := os.MkdirTemp("", "quickserv_upload_")
+		if err != nil {
+			logger.Println(err)
+			logger.Println("Couldn't make a temporary folder for uploaded files.")
 			http.Error(w, http.StatusText(500), 500)
 			return
 		}
+		defer os.RemoveAll(uploadDir)
+
+		if config.MaxUploadMB > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadMB<<20)
+		}
+		form, err = SaveMultipartForm(r, uploadDir)
+		if err != nil {
+			logger.Println(err)
+			logger.Println("Couldn't save the uploaded files.")
+			ServeBodyError(w, err, 400)
+			return
+		}
+		isForm = true
+	}
+	argFields = append(argFields, form...)
+
+	// Get JSON object fields as additional arguments if applicable. The body
+	// is still passed to the program unchanged.
+	var jsonForm []FormField
+	if config.JSONArgs && IsJSONRequest(r) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Println(err)
+			logger.Println("Couldn't read the request body.")
+			ServeBodyError(w, err, 500)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
 
-		formArguments = GetFormAsArguments(r.Form)
+		jsonForm, err = FlattenJSON(body)
+		if err != nil {
+			// Not every JSON body is an object, so this is not an error
+			logger.Println(err)
+			logger.Println("Couldn't turn the JSON request body into arguments.")
+		}
+		argFields = append(argFields, jsonForm...)
 	}
+	formArguments := GetArguments(argFields, settings.ArgStyle)
 
 	var cmd *exec.Cmd
 	if shebang := GetShebang(execPath); shebang == "" {
@@ -412,6 +1606,32 @@ func ExecutePath(ctx context.Context, execPath string, w http.ResponseWriter, r
 	// Create the command using all environment variables. Include a
 	// REQUEST_METHOD environment variable in imitation of CGI
 	cmd.Env = append(os.Environ(), "REQUEST_METHOD="+r.Method)
+	for _, param := range route.Params {
+		cmd.Env = append(cmd.Env, "PARAM_"+GetEnvName(param.Name)+"="+param.Value)
+	}
+	if route.Status != 0 {
+		// Error pages get the original request in the same variables Apache
+		// uses for them
+		cmd.Env = append(cmd.Env,
+			"REDIRECT_STATUS="+strconv.Itoa(route.Status),
+			"REDIRECT_URL="+r.URL.RequestURI(),
+		)
+	}
+
+	// Pass form variables as environment variables too. Variables from the
+	// query string are also passed separately.
+	cmd.Env = append(cmd.Env, GetFormAsEnv("FORM_", form)...)
+	cmd.Env = append(cmd.Env, GetFormAsEnv("JSON_", jsonForm)...)
+	if query, err := ParseQuery(r.URL.RawQuery); err == nil {
+		cmd.Env = append(cmd.Env, GetFormAsEnv("QUERY_", query)...)
+	}
+	cmd.Env = append(cmd.Env, "SCRIPT_NAME="+route.Path, "PATH_INFO="+route.PathInfo)
+	if route.PathInfo != "" {
+		translated, err := filepath.Abs(filepath.FromSlash("." + route.PathInfo))
+		if err == nil {
+			cmd.Env = append(cmd.Env, "PATH_TRANSLATED="+translated)
+		}
+	}
 
 	// I tried to do exec.CommandContext here, but it doesn't kill child
 	// processes, so anything run from a script keeps on going when the
@@ -439,40 +1659,42 @@ func ExecutePath(ctx context.Context, execPath string, w http.ResponseWriter, r
 		http.Error(w, http.StatusText(500), 500)
 		return
 	}
+	stdinDone := make(chan error, 1)
 	go func() {
 		defer stdin.Close()
 
-		if r.Method == "GET" || (len(r.Header["Content-Type"]) > 0 &&
-			r.Header["Content-Type"][0] == "application/x-www-form-urlencoded") {
-			// If the submission is a GET request, or is a form submission
-			// according to content type, treat it like a form
-			formData, err := DecodeForm(r.Form)
-			if err != nil {
-				logger.Println(err)
-				logger.Println("Couldn't percent-decode the request form.")
-				http.Error(w, http.StatusText(500), 500)
-				return
+		var err error
+		if isForm {
+			// If the submission is a GET or HEAD request, or is a form
+			// submission according to content type, treat it like a form.
+			// Saved uploads are included as their file paths.
+			formData := DecodeForm(form)
+			if settings.ArgStyle == ArgStyleJSON {
+				formData = FormToJSON(form)
 			}
 			_, err = io.Copy(stdin, bytes.NewReader(formData))
 			if err != nil {
 				logger.Println(err)
+				// Programs that exit without reading all of their input are
+				// fine, so only log the error. The exit status of the program
+				// determines the response.
 				logger.Println("Couldn't copy the form data to the program.")
-				http.Error(w, http.StatusText(500), 500)
-				return
 			}
 		} else {
 			// This POST/PUT/DELETE data is not form data (may be a JSON API
 			// request, for example), so don't encode it as a form. If it is a
 			// multipart or other form submission, it will be properly encoded
 			// already.
-			_, err := io.Copy(stdin, r.Body)
+			_, err = io.Copy(stdin, r.Body)
 			if err != nil {
 				logger.Println(err)
+				// Programs that exit without reading all of their input are
+				// fine, so only log the error. The exit status of the program
+				// determines the response.
 				logger.Println("Couldn't copy the request body to the program.")
-				http.Error(w, http.StatusText(500), 500)
-				return
 			}
 		}
+		stdinDone <- err
 	}()
 
 	// Print out stderror messages for debugging
@@ -492,7 +1714,7 @@ func ExecutePath(ctx context.Context, execPath string, w http.ResponseWriter, r
 	}()
 
 	// Kill the process if the user terminates their connection
-	cmdDone := make(chan error)
+	cmdDone := make(chan error, 1)
 	go func() {
 		select {
 		case <-ctx.Done():
@@ -501,21 +1723,558 @@ func ExecutePath(ctx context.Context, execPath string, w http.ResponseWriter, r
 				logger.Println(err)
 			}
 
-		case <-cmdDone:
-			return
+		case <-cmdDone:
+			return
+		}
+	}()
+
+	// Save the output in a temporary file, rather than in memory, so that
+	// large output such as video can be sent in parts for Range requests.
+	// Hash it along the way for the ETag.
+	outFile, err := os.CreateTemp("", "quickserv_output_")
+	if err != nil {
+		logger.Println(err)
+		logger.Println("Couldn't make a temporary file for the program output.")
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+	hash := sha256.New()
+	cmd.Stdout = io.MultiWriter(outFile, hash)
+
+	// Execute the command and write the output as the HTTP response
+	err = cmd.Run()
+	cmdDone <- err
+
+	// Wait for the request body to finish being copied, so that it is not
+	// read after the response is sent. If the program exited before reading
+	// all of it, stop waiting on the client for the rest by cutting off
+	// reading from the connection.
+	var bodyErr error
+	select {
+	case bodyErr = <-stdinDone:
+	default:
+		if !isForm {
+			if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+				conn.SetReadDeadline(time.Now())
+			}
+			r.Body.Close()
+		}
+		<-stdinDone
+	}
+
+	// If the request body was too large or too slow, the program only got
+	// part of it, so its output can't be trusted
+	var netErr net.Error
+	if IsBodyTooLarge(bodyErr) || (errors.As(bodyErr, &netErr) && netErr.Timeout()) {
+		ServeBodyError(w, bodyErr, 500)
+		return
+	}
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// Set the type of the output if the program declares one, and guess it
+	// otherwise
+	output := Output{ETag: `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`}
+	output.ContentType, output.Declared, err = GetOutputType(execPath, settings.ContentType, outFile)
+	if err == nil && cacheKey != "" {
+		// Cached output is kept in memory, since the temporary file is deleted
+		if _, err = outFile.Seek(0, io.SeekStart); err == nil {
+			output.Body, err = io.ReadAll(outFile)
+		}
+		if err == nil {
+			output.Expires = time.Now().Add(cacheTTL)
+			CacheOutput(cacheKey, output)
+		}
+	}
+	if err == nil {
+		_, err = outFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		logger.Println(err)
+		logger.Println("Couldn't read the program output.")
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	ServeOutput(w, r, route.Status, output, outFile)
+}
+
+// ServeOutput writes the output of a program as the response. Browsers are told
+// not to second-guess declared content types. Unless the response is an error
+// page, it is sent with http.ServeContent, which uses the ETag to answer
+// conditional requests (like If-None-Match) and Range requests.
+func ServeOutput(w http.ResponseWriter, r *http.Request, status int, output Output, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", output.ContentType)
+	if output.Declared {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+
+	// For HEAD requests, net/http discards the body
+	ExtendWriteDeadline(r)
+	if status != 0 {
+		w.WriteHeader(status)
+		io.Copy(w, content)
+		return
+	}
+	w.Header().Set("ETag", output.ETag)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// StaticETag returns a weak entity tag for a static file based on its size
+// and modification time, so that the file doesn't have to be read to make one.
+func StaticETag(d fs.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, d.ModTime().UnixNano(), d.Size())
+}
+
+// GetCacheKey returns the key that the output of the route is saved under. The
+// output is only reused for requests with the same method, path, query string,
+// and body. Other parts of the request, such as headers, are ignored.
+func GetCacheKey(route Route, r *http.Request, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{r.Method, route.Path, r.URL.RequestURI()} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GetCachedOutput returns saved program output for the key if there is any that
+// hasn't expired.
+func GetCachedOutput(key string) (Output, bool) {
+	outputCache.Lock()
+	defer outputCache.Unlock()
+	output, found := outputCache.entries[key]
+	if found && time.Now().After(output.Expires) {
+		delete(outputCache.entries, key)
+		return Output{}, false
+	}
+	return output, found
+}
+
+// CacheOutput saves program output under the key until it expires. Expired
+// output is removed at the same time so that the cache doesn't keep growing.
+func CacheOutput(key string, output Output) {
+	outputCache.Lock()
+	defer outputCache.Unlock()
+	now := time.Now()
+	for k, saved := range outputCache.entries {
+		if now.After(saved.Expires) {
+			delete(outputCache.entries, k)
+		}
+	}
+	outputCache.entries[key] = output
+}
+
+// GetOutputType returns the content type of a program's output, and whether
+// the type was declared rather than guessed. A type is declared if it is set
+// in the configuration file, or if the program's filename has a second file
+// extension with a known type. For example, the output of report.csv.py is
+// CSV, and the output of data.json.sh is JSON. Method names are skipped, so the
+// output of report.csv.get.py is CSV too.
+//
+// Otherwise, the type is guessed from the output. Output that would be guessed
+// as plain text is treated as JSON if it is a valid JSON object or array.
+func GetOutputType(execPath, configured string, out io.ReadSeeker) (string, bool, error) {
+	if configured != "" {
+		return configured, true, nil
+	}
+
+	_, filename := path.Split(execPath)
+	name, method := SplitMethodName(filename)
+	if method == "" {
+		name = strings.TrimSuffix(filename, path.Ext(filename))
+	}
+	inner := path.Ext(name)
+	if contentType := mime.TypeByExtension(inner); inner != "" && contentType != "" {
+		return contentType, true, nil
+	}
+
+	// Only the start of the output is needed to guess its type
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	start := make([]byte, 512)
+	n, err := io.ReadFull(out, start)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", false, err
+	}
+	contentType := http.DetectContentType(start[:n])
+	if trimmed := bytes.TrimSpace(start[:n]); strings.HasPrefix(contentType, "text/plain") &&
+		len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return "", false, err
+		}
+		if IsJSON(out) {
+			return "application/json", false, nil
+		}
+	}
+	return contentType, false, nil
+}
+
+// IsJSON returns whether the input is a single valid JSON value. It reads the
+// input one token at a time, so that large input doesn't have to be kept in
+// memory.
+func IsJSON(r io.Reader) bool {
+	decoder := json.NewDecoder(r)
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			break
+		}
+	}
+	_, err := decoder.Token()
+	return err == io.EOF
+}
+
+// ServeOptions answers an OPTIONS request for an executable route without
+// running it, so that CORS preflight requests don't cause side effects.
+func ServeOptions(w http.ResponseWriter, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeExecutable runs the executable for the route, unless the
+// request is an OPTIONS request, or a HEAD request that the user doesn't want
+// scripts to run for. The allowed methods are reported in response to OPTIONS
+// requests.
+func ServeExecutable(route Route, allowed []string, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "OPTIONS":
+		ServeOptions(w, allowed)
+	case r.Method == "HEAD" && config.NoHeadExec:
+		w.WriteHeader(http.StatusOK)
+	default:
+		ExecutePath(r.Context(), route, w, r)
+	}
+}
+
+// SplitMethodName splits a method-specific handler filename into the name it
+// handles and the HTTP method it handles. For example:
+//
+//	users.delete.sh -> users, DELETE
+//	index.post.py   -> index, POST
+//	index.get       -> index, GET
+//
+// If the filename does not name a method, the method is the empty string.
+// OPTIONS requests are always answered by QuickServ, so there are no OPTIONS
+// handlers.
+func SplitMethodName(filename string) (string, string) {
+	isMethod := func(ext string) bool {
+		method := strings.ToUpper(strings.TrimPrefix(ext, "."))
+		for _, m := range executableMethods {
+			if method == m && method != "OPTIONS" {
+				return true
+			}
+		}
+		return false
+	}
+
+	ext := path.Ext(filename)
+	stem := strings.TrimSuffix(filename, ext)
+	if inner := path.Ext(stem); isMethod(inner) {
+		return strings.TrimSuffix(stem, inner), strings.ToUpper(inner[1:])
+	}
+	if isMethod(ext) {
+		return stem, strings.ToUpper(ext[1:])
+	}
+	return filename, ""
+}
+
+// HandlerMethods returns the methods an executable file handles, in the format
+// of the Allow header. Files named for a specific method, like users.post.py,
+// only handle that method, and GET handlers also handle HEAD. Other files
+// handle every method.
+func HandlerMethods(filename string) []string {
+	_, method := SplitMethodName(filename)
+	if method == "" {
+		return executableMethods
+	}
+	var allowed []string
+	for _, m := range executableMethods {
+		if m == "OPTIONS" || m == method || (m == "HEAD" && method == "GET") {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// AllowsMethod returns whether the method is in the list of allowed methods.
+func AllowsMethod(allowed []string, method string) bool {
+	for _, m := range allowed {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// FindHandlers returns the executable files in the directory listing whose
+// names match, keyed by the HTTP method each one handles. Names are compared
+// without file extensions or method names, so users.post.py is matched by the
+// name "users". Files that handle every method are keyed by the empty string.
+//
+// NOTE: The input dir is expected to be a rooted path with forward slashes, and
+// the output has the same format
+func FindHandlers(dir string, files []fs.FileInfo, match func(name string) bool) map[string]string {
+	handlers := make(map[string]string)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		filename := file.Name()
+		name, method := SplitMethodName(filename)
+		if method == "" {
+			name = strings.TrimSuffix(filename, path.Ext(filename))
+		}
+		if handlerPath := path.Join(dir, filename); match(name) &&
+			IsPathExecutable(handlerPath, file) {
+			handlers[method] = handlerPath
+		}
+	}
+	return handlers
+}
+
+// PickHandler chooses the handler for the method from handlers returned by
+// FindHandlers. HEAD requests are handled by the GET handler if there is no
+// specific HEAD handler, and methods without a specific handler fall back on
+// the handler for every method (if any).
+//
+// It also returns the methods allowed by the handlers, in the format of the
+// Allow header. If there are no handlers, the list is empty.
+func PickHandler(handlers map[string]string, method string) (string, []string) {
+	if len(handlers) == 0 {
+		return "", nil
+	}
+	if _, ok := handlers["HEAD"]; !ok {
+		if get, ok := handlers["GET"]; ok {
+			handlers["HEAD"] = get
+		}
+	}
+	if generic, ok := handlers[""]; ok {
+		if handler, ok := handlers[method]; ok {
+			return handler, executableMethods
+		}
+		return generic, executableMethods
+	}
+
+	var allowed []string
+	for _, m := range executableMethods {
+		if _, ok := handlers[m]; ok || m == "OPTIONS" {
+			allowed = append(allowed, m)
+		}
+	}
+	return handlers[method], allowed
+}
+
+// ReadDir returns the sorted contents of the directory, or nil if it can't be
+// read. Hidden and ignored files and folders are left out.
+//
+// NOTE: The input dir is expected to be a rooted path with forward slashes
+func ReadDir(dir string) []fs.FileInfo {
+	file, err := SafeDir(".").Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	all, err := file.Readdir(-1)
+	if err != nil {
+		return nil
+	}
+	var files []fs.FileInfo
+	for _, f := range all {
+		if f.Mode()&fs.ModeSymlink != 0 {
+			// Use information about what the link points to, if it's allowed
+			linkPath := filepath.FromSlash("." + path.Join(dir, f.Name()))
+			if CheckSymlinks(linkPath) != nil {
+				continue
+			} else if f, err = os.Stat(linkPath); err != nil {
+				continue
+			}
+		}
+		if !IsHiddenName(f.Name()) && !IsIgnoredPath(path.Join(dir, f.Name()), f.IsDir()) {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files
+}
+
+// FindMethodHandler looks in the directory for executable files that handle
+// specific HTTP methods for the name given as input (for example users.post.py
+// for the name "users"). It returns the path of the handler for the input
+// method, or the empty string if there is none. HEAD requests are handled by
+// the GET handler if there is no specific HEAD handler.
+//
+// It also returns the methods allowed for the name, in the format of the Allow
+// header. If there are no method-specific handlers, the list is empty.
+//
+// NOTE: The input dir is expected to be a rooted path with forward slashes, and
+// the output has the same format
+func FindMethodHandler(dir, name, method string) (string, []string) {
+	handlers := FindHandlers(dir, ReadDir(dir), func(n string) bool {
+		return strings.ToLower(n) == strings.ToLower(name)
+	})
+	delete(handlers, "")
+	return PickHandler(handlers, method)
+}
+
+// ParseParamName returns the name of the path parameter captured by a file or
+// folder name like [id], and whether it captures the rest of the path, like
+// [...rest]. If the input isn't in brackets, the last returned value is false.
+func ParseParamName(name string) (string, bool, bool) {
+	if len(name) < 3 || !strings.HasPrefix(name, "[") || !strings.HasSuffix(name, "]") {
+		return "", false, false
+	}
+	name = name[1 : len(name)-1]
+	if strings.HasPrefix(name, "...") {
+		return name[3:], true, len(name) > 3
+	}
+	return name, false, true
+}
+
+// FindDynamicRoute finds the executable file that handles the path segments
+// relative to the input directory, where files and folders named like [id]
+// match any one segment, and those named like [...rest] match all remaining
+// segments. Exact matches are preferred over [id] matches, which are preferred
+// over [...rest] matches.
+//
+// If an executable file matches before the end of the segments, it handles the
+// request, and the remaining segments are its path info. For example, for
+// /api/users.py/42/edit, the route is /api/users.py with the path info /42/edit.
+//
+// It also returns the methods allowed by the handlers for the matched path, in
+// the format of the Allow header. If the path matched, but there is no
+// handler for the method, the returned route has an empty path, and the allowed
+// list is not empty.
+//
+// NOTE: The input dir is expected to be a rooted path with forward slashes, and
+// the output has the same format
+func FindDynamicRoute(dir string, segments []string, method string, params []Param) (Route, []string) {
+	withParam := func(name, value string) []Param {
+		return append(append([]Param{}, params...), Param{name, value})
+	}
+	paramMatches := func(catchAll bool) func(string) bool {
+		return func(name string) bool {
+			_, isCatchAll, ok := ParseParamName(name)
+			return ok && isCatchAll == catchAll
+		}
+	}
+	handlerParam := func(handler string) string {
+		name, method := SplitMethodName(path.Base(handler))
+		if method == "" {
+			name = strings.TrimSuffix(name, path.Ext(name))
+		}
+		param, _, _ := ParseParamName(name)
+		return param
+	}
+
+	if len(segments) == 0 {
+		index, found := FindIndexFile(dir, method)
+		_, allowed := FindMethodHandler(dir, "index", method)
+		if _, generic := FindIndexFile(dir, ""); generic {
+			allowed = executableMethods
+		}
+		if !found {
+			return Route{}, allowed
+		}
+		return Route{Path: index, Params: params}, allowed
+	}
+	segment, rest := segments[0], segments[1:]
+	files := ReadDir(dir)
+
+	// Try exact matches first
+	for _, file := range files {
+		if file.Name() != segment {
+			continue
+		}
+		if file.IsDir() {
+			route, allowed := FindDynamicRoute(path.Join(dir, segment), rest, method, params)
+			if route.Path != "" || len(allowed) > 0 {
+				return route, allowed
+			}
+		} else if filePath := path.Join(dir, segment); IsPathExecutable(filePath, file) {
+			allowed := HandlerMethods(segment)
+			if !AllowsMethod(allowed, method) {
+				return Route{}, allowed
+			}
+			var pathInfo string
+			if len(rest) > 0 {
+				pathInfo = "/" + strings.Join(rest, "/")
+			}
+			return Route{Path: filePath, Params: params, PathInfo: pathInfo}, allowed
+		}
+	}
+	if len(rest) == 0 {
+		if handler, allowed := FindMethodHandler(dir, segment, method); len(allowed) > 0 {
+			return Route{Path: handler, Params: params}, allowed
+		}
+	}
+
+	// Then try folders and files that match one segment
+	for _, file := range files {
+		if param, catchAll, ok := ParseParamName(file.Name()); ok && !catchAll && file.IsDir() {
+			route, allowed := FindDynamicRoute(path.Join(dir, file.Name()), rest, method,
+				withParam(param, segment))
+			if route.Path != "" || len(allowed) > 0 {
+				return route, allowed
+			}
+		}
+	}
+	if len(rest) == 0 {
+		handlers := FindHandlers(dir, files, paramMatches(false))
+		if handler, allowed := PickHandler(handlers, method); len(allowed) > 0 {
+			if handler == "" {
+				return Route{}, allowed
+			}
+			return Route{Path: handler, Params: withParam(handlerParam(handler), segment)}, allowed
+		}
+	}
+
+	// Finally try folders and files that match all remaining segments
+	value := strings.Join(segments, "/")
+	for _, file := range files {
+		if param, catchAll, ok := ParseParamName(file.Name()); ok && catchAll && file.IsDir() {
+			route, allowed := FindDynamicRoute(path.Join(dir, file.Name()), nil, method,
+				withParam(param, value))
+			if route.Path != "" || len(allowed) > 0 {
+				return route, allowed
+			}
 		}
-	}()
+	}
+	handlers := FindHandlers(dir, files, paramMatches(true))
+	handler, allowed := PickHandler(handlers, method)
+	if handler == "" {
+		return Route{}, allowed
+	}
+	return Route{Path: handler, Params: withParam(handlerParam(handler), value)}, allowed
+}
 
-	// Execute the command and write the output as the HTTP response
-	out, err := cmd.Output()
-	cmdDone <- err
-	if err != nil {
-		logger.Println(err)
-		http.Error(w, http.StatusText(500), 500)
+// ServeMethodNotAllowed responds to a request for a path that has handlers for
+// some methods, but not for the method of the request.
+func ServeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) {
+	if r.Method == "OPTIONS" {
+		ServeOptions(w, allowed)
 		return
 	}
-
-	w.Write(out)
+	logger.Printf("No %v handler for %v\n", r.Method, r.URL.Path)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, http.StatusText(405), 405)
 }
 
 // FindIndexFile returns the path to the index file of the directory path given
@@ -523,21 +2282,24 @@ func ExecutePath(ctx context.Context, execPath string, w http.ResponseWriter, r
 // error during the search, the the first returned value is the empty string and
 // the second value is false.
 //
+// If the method is not the empty string, an index file that handles that
+// specific method (such as index.post.py for POST) is preferred. Index files for
+// other methods are never returned.
+//
 // NOTE: The input dir is expected to be a rooted path with forward slashes, and
 // the output has the same format
-func FindIndexFile(dir string) (string, bool) {
-	file, err := http.Dir(".").Open(dir)
-	if err != nil {
-		return "", false
+func FindIndexFile(dir string, method string) (string, bool) {
+	if method != "" {
+		if index, _ := FindMethodHandler(dir, "index", method); index != "" {
+			return index, true
+		}
 	}
-	defer file.Close()
 
-	files, err := file.Readdir(-1)
-	if err != nil {
-		return "", false
-	}
-	for _, file := range files {
+	for _, file := range ReadDir(dir) {
 		filename := file.Name()
+		if _, m := SplitMethodName(filename); m != "" {
+			continue
+		}
 		if IsPathExecutable(path.Clean(dir+"/"+filename), file) &&
 			strings.ToLower(strings.TrimSuffix(filename, path.Ext(filename))) == "index" {
 			return path.Join(dir, filename), true
@@ -549,7 +2311,8 @@ func FindIndexFile(dir string) (string, bool) {
 // FindExecutablePaths walks the current directory and locates paths that will
 // be executed when visited. It returns them as a map. In the map keys are paths
 // that cause a file to be executed, and values are either the empty string or
-// the file to be executed when the path is accessed.
+// the file to be executed when the path is accessed. Paths only executed for
+// one HTTP method are preceded by that method, like "POST /users".
 func FindExecutablePaths(logfileName string) (map[string]string, error) {
 	routes := make(map[string]string)
 
@@ -566,6 +2329,13 @@ func FindExecutablePaths(logfileName string) (map[string]string, error) {
 		// Also ignore the logfile if it's present.
 		_, filename := filepath.Split(path)
 		fileinfo, err := d.Info()
+		if err == nil && d.Type()&fs.ModeSymlink != 0 {
+			// Use information about what the link points to, if it's allowed
+			linkPath := filepath.FromSlash("." + path)
+			if err = CheckSymlinks(linkPath); err == nil {
+				fileinfo, err = os.Stat(linkPath)
+			}
+		}
 		if err != nil {
 			logger.Printf("Couldn't get file info for %v.\n", filename)
 			return nil
@@ -574,18 +2344,49 @@ func FindExecutablePaths(logfileName string) (map[string]string, error) {
 			return nil
 		}
 
+		// Don't look inside of hidden or ignored folders, which can be large
+		// (like .git or node_modules)
+		if IsHiddenName(d.Name()) || IsIgnoredPath(path, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		// Find the index file if path is a directory
 		if fileinfo.IsDir() {
-			index, found := FindIndexFile(path)
+			index, found := FindIndexFile(path, "")
 			if found {
 				routes[path] = index
 			}
 			return nil
 		}
 
-		// Print a result if executable
+		// Print a result if executable, along with the route it handles if
+		// it is specific to one HTTP method
 		if IsPathExecutable(path, fileinfo) {
-			routes[path] = ""
+			if name, method := SplitMethodName(filename); method != "" {
+				dir := strings.TrimSuffix(path, filename)
+				route := dir + name
+				if strings.ToLower(name) == "index" && dir != "/" {
+					route = strings.TrimSuffix(dir, "/")
+				} else if strings.ToLower(name) == "index" {
+					route = dir
+				}
+				routes[method+" "+route] = path
+			} else if _, _, ok := ParseParamName(strings.TrimSuffix(filename, filepath.Ext(filename))); ok {
+				routes[strings.TrimSuffix(path, filepath.Ext(filename))] = path
+			} else if clean := strings.TrimSuffix(path, filepath.Ext(filename)); config.CleanURLs {
+				// Pages like about.html are visited instead of about.py at
+				// the clean URL, unless the request uses another method
+				if file, _ := FindCleanURLFile(clean, "GET"); file == path {
+					routes[clean] = path
+				} else {
+					routes[path] = ""
+				}
+			} else {
+				routes[path] = ""
+			}
 		}
 		return nil
 	})
@@ -622,18 +2423,515 @@ func ServeStaticFile(local http.Handler, reqPath string, w http.ResponseWriter,
 	http.ServeContent(w, r, reqPath, d.ModTime(), f.(io.ReadSeeker))
 }
 
+// FindCleanURLFile finds the file to use for a path without a file extension,
+// like about.html or about.py for /about, when requested with the input method.
+// If there is a handler for the name specific to the method, like
+// contact.post.py, no file is returned, so that the handler is used instead.
+// For GET and HEAD requests, files with the clean URL extensions from the
+// configuration are tried next, in order. Otherwise, any executable file with
+// the name and an extension is used, the same way as index files.
+//
+// NOTE: The input path is expected to be rooted with forward slashes, and the
+// output has the same format
+func FindCleanURLFile(reqPath, method string) (string, bool) {
+	dir, name := path.Split(reqPath)
+	if name == "" {
+		return "", false
+	}
+	if handler, _ := FindMethodHandler(dir, name, method); handler != "" {
+		return "", false
+	}
+	files := ReadDir(dir)
+	if method == "GET" || method == "HEAD" {
+		for _, ext := range config.CleanURLExtensions {
+			for _, file := range files {
+				if !file.IsDir() && file.Name() == name+ext {
+					return path.Join(dir, file.Name()), true
+				}
+			}
+		}
+	}
+	handlers := FindHandlers(dir, files, func(n string) bool { return n == name })
+	if handler, ok := handlers[""]; ok {
+		return handler, true
+	}
+	return "", false
+}
+
+// IsCleanURLExtension returns whether files with the extension can be visited
+// without it when clean URLs are on.
+func IsCleanURLExtension(ext string) bool {
+	for _, e := range config.CleanURLExtensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeAppIndex serves the index.html file closest to a path that doesn't
+// exist, so that single-page apps can handle the path themselves. It looks in
+// the directory of the request path first, and then in each parent directory
+// up to the root. It returns false without serving anything if there is no
+// index.html, or if there is a default file for the path.
+//
+// NOTE: The input path is expected to be rooted with forward slashes
+func ServeAppIndex(filesystem http.FileSystem, reqPath string, w http.ResponseWriter, r *http.Request) bool {
+	if f, err := embedFS.Open(strings.TrimPrefix(reqPath, "/")); err == nil {
+		f.Close()
+		return false
+	}
+
+	for dir := path.Dir(reqPath); ; dir = path.Dir(dir) {
+		for _, file := range ReadDir(dir) {
+			if file.IsDir() || file.Name() != "index.html" {
+				continue
+			}
+			index := path.Join(dir, file.Name())
+			f, err := filesystem.Open(index)
+			if err != nil {
+				logger.Println(err)
+				return false
+			}
+			defer f.Close()
+
+			logger.Printf("Serving %v for %v\n", index, reqPath)
+			SetRouteHeaders(w, reqPath, index)
+			w.Header().Set("Content-Type", mime.TypeByExtension(".html"))
+			w.Header().Set("ETag", StaticETag(file))
+			http.ServeContent(w, r, index, file.ModTime(), f)
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+// FindErrorPage looks for a custom page for the error status code, such as
+// 404.html or 404.py. It looks in the directory of the request path first, and
+// then in each parent directory up to the root. Executable error pages are
+// preferred over static ones. Static error pages must be HTML, so that a 404.py
+// that isn't executable doesn't show its source code.
+//
+// NOTE: The input path is expected to be rooted with forward slashes, and the
+// output has the same format
+func FindErrorPage(reqPath string, code int) (string, bool) {
+	name := strconv.Itoa(code)
+	for dir := path.Dir(reqPath); ; dir = path.Dir(dir) {
+		var files []fs.FileInfo
+		if !IsHiddenPath(dir) {
+			files = ReadDir(dir)
+		}
+		handlers := FindHandlers(dir, files, func(n string) bool { return n == name })
+		if handler, ok := handlers[""]; ok {
+			return handler, true
+		}
+		for _, file := range files {
+			filename := file.Name()
+			if !file.IsDir() && (filename == name+".html" || filename == name+".htm") {
+				return path.Join(dir, filename), true
+			}
+		}
+		if dir == "/" {
+			return "", false
+		}
+	}
+}
+
+// ServeErrorPage responds with the error page at the path, either by executing
+// it or by serving its contents, along with the error status code.
+func ServeErrorPage(page string, code int, w http.ResponseWriter, r *http.Request) {
+	logger.Printf("Serving error page %v\n", page)
+
+	// Remove headers left over from the original error response, but keep
+	// the nosniff header if the security preset asked for it
+	w.Header().Del("Content-Type")
+	w.Header().Del("Content-Length")
+	w.Header().Del("X-Content-Type-Options")
+	if value, ok := securityHeaderPresets[config.SecurityHeaders]["X-Content-Type-Options"]; ok {
+		w.Header().Set("X-Content-Type-Options", value)
+	}
+
+	f, err := SafeDir(".").Open(page)
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		logger.Println(err)
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	if IsPathExecutable(page, d) {
+		// Like other programs, error pages aren't run for OPTIONS requests,
+		// or for HEAD requests if the user doesn't want
+		if r.Method == "OPTIONS" || (r.Method == "HEAD" && config.NoHeadExec) {
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		ExecutePath(r.Context(), Route{Path: page, Status: code}, w, r)
+		return
+	}
+	if contentType := mime.TypeByExtension(path.Ext(page)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(code)
+	io.Copy(w, f)
+}
+
+// errorPageWriter wraps a ResponseWriter, and replaces error responses with
+// custom error pages when there are any.
+type errorPageWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *errorPageWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code >= 400 {
+		// Errors shouldn't be cached like the content would have been
+		w.Header().Del("Cache-Control")
+		if page, found := FindErrorPage(path.Clean(w.r.URL.Path), code); found {
+			w.replaced = true
+			ServeErrorPage(page, code, w.ResponseWriter, w.r)
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		// Discard the original error message
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// AcceptsEncoding returns whether the request allows a response with the input
+// content encoding, such as "gzip" or "br", according to its Accept-Encoding
+// header.
+func AcceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(accepted, ";")
+		if strings.TrimSpace(parts[0]) != encoding {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if weight, err := strconv.ParseFloat(q[2:], 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// IsCompressible returns whether responses with the content type are worth
+// compressing. Most image, video, audio, and archive formats are already
+// compressed.
+func IsCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/x-javascript",
+		"application/xml", "application/wasm", "image/svg+xml", "image/bmp",
+		"image/x-icon", "image/vnd.microsoft.icon", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// gzipWriter wraps a ResponseWriter, and compresses the response with gzip if
+// it is large enough, and of a type worth compressing. It waits until it has
+// enough of the response to decide before writing anything, so Close must be
+// called once the response is done.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide chooses whether to compress, and writes the headers and anything
+// written so far.
+func (w *gzipWriter) decide() error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	h := w.Header()
+	contentType := h.Get("Content-Type")
+	if contentType == "" && len(w.buf) > 0 {
+		// Guess the type now, since net/http can't guess it from compressed
+		// data later
+		contentType = http.DetectContentType(w.buf)
+		h.Set("Content-Type", contentType)
+	}
+	if w.status == http.StatusOK && len(w.buf) >= w.minSize &&
+		h.Get("Content-Encoding") == "" && IsCompressible(contentType) {
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", "gzip")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			// The compressed response isn't byte-for-byte the same
+			h.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if w.status != http.StatusNotModified && !strings.Contains(h.Get("Vary"), "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else if len(w.buf) > 0 {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Close writes anything left in the response.
+func (w *gzipWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			// Nothing was written, so let net/http handle it
+			return nil
+		}
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+// ServePrecompressed serves a precompressed version of a static file, such as
+// script.js.br or script.js.gz for script.js, if there is one that the client
+// accepts. It returns false if there isn't one.
+//
+// NOTE: The input path is expected to be rooted with forward slashes
+func ServePrecompressed(filesystem http.FileSystem, reqPath string, w http.ResponseWriter, r *http.Request) bool {
+	encodings := []struct{ name, ext string }{{"br", ".br"}, {"zstd", ".zst"}, {"gzip", ".gz"}}
+	for _, encoding := range encodings {
+		if !AcceptsEncoding(r, encoding.name) {
+			continue
+		}
+		f, err := filesystem.Open(reqPath + encoding.ext)
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		d, err := f.Stat()
+		if err != nil || d.IsDir() {
+			continue
+		}
+
+		logger.Printf("Serving %v version of %v\n", encoding.name, reqPath)
+		contentType := mime.TypeByExtension(path.Ext(reqPath))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Encoding", encoding.name)
+		w.Header().Add("Vary", "Accept-Encoding")
+		http.ServeContent(w, r, reqPath, d.ModTime(), f)
+		return true
+	}
+	return false
+}
+
+// FormatSize returns a file size in bytes as a short, human-readable string
+// such as "12 KB".
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, prefix := float64(size)/unit, 0
+	for ; value >= unit && prefix < 4; prefix++ {
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f %cB", value, "KMGTP"[prefix])
+}
+
+// SortListing sorts directory listing entries by name, size, or modified time,
+// with folders first. Entries with the same value are sorted by name.
+func SortListing(entries []ListingEntry, by string, descending bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if descending {
+			a, b = b, a
+		}
+		switch {
+		case by == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case by == "modified" && !a.Modified.Equal(b.Modified):
+			return a.Modified.Before(b.Modified)
+		}
+		return a.Name < b.Name
+	})
+}
+
+// ServeDirectoryListing lists the contents of a folder as a web page, or as
+// JSON if the client asks for it with the Accept header. Entries are sorted
+// using the sort ("name", "size", or "modified") and order ("asc" or "desc")
+// query parameters.
+//
+// NOTE: The input dir is expected to be a rooted path with forward slashes
+func ServeDirectoryListing(dir string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	by, order := query.Get("sort"), query.Get("order")
+	if by != "size" && by != "modified" {
+		by = "name"
+	}
+	if order != "desc" {
+		order = "asc"
+	}
+
+	entries := []ListingEntry{}
+	for _, file := range ReadDir(dir) {
+		name := file.Name()
+		link := (&url.URL{Path: name}).String()
+		if file.IsDir() {
+			link += "/"
+		}
+		entries = append(entries, ListingEntry{
+			Name:       name,
+			Link:       link,
+			Size:       file.Size(),
+			Modified:   file.ModTime(),
+			IsDir:      file.IsDir(),
+			Executable: !file.IsDir() && IsPathExecutable(path.Join(dir, name), file),
+		})
+	}
+	SortListing(entries, by, order == "desc")
+	if dir != "/" {
+		dir += "/"
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Path    string         `json:"path"`
+			Entries []ListingEntry `json:"entries"`
+		}{dir, entries})
+		return
+	}
+
+	// Clicking a column header sorts by it, or reverses the order if the
+	// listing is already sorted by it
+	type column struct{ Label, Link, Arrow string }
+	var columns []column
+	for _, c := range []struct{ key, label string }{
+		{"name", "Name"}, {"size", "Size"}, {"modified", "Modified"},
+	} {
+		next, arrow := "asc", ""
+		if c.key == by && order == "asc" {
+			next, arrow = "desc", "▲"
+		} else if c.key == by {
+			arrow = "▼"
+		}
+		columns = append(columns, column{c.label, "?sort=" + c.key + "&order=" + next, arrow})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := listingTemplate.Execute(w, struct {
+		Path    string
+		Columns []column
+		Entries []ListingEntry
+	}{dir, columns, entries})
+	if err != nil {
+		logger.Println(err)
+	}
+}
+
 // NewMainHandler returns an http.Handler that looks at the file a user requests
 // and decides whether to execute it, or pass it to an http.FileServer.
 func NewMainHandler(filesystem http.FileSystem) http.Handler {
 	fileserver := http.FileServer(filesystem)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Compress responses if the user wants and the client can handle it
+		if config.Compress && AcceptsEncoding(r, "gzip") {
+			gz := &gzipWriter{ResponseWriter: w, minSize: config.CompressMinBytes}
+			defer gz.Close()
+			w = gz
+		}
+
+		// Replace error responses with custom error pages if there are any
+		w = &errorPageWriter{ResponseWriter: w, r: r}
+
 		// Write maximally permissive CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		w.Header().Set("Access-Control-Expose-Headers", "*")
 
+		// Cross-origin isolation lets pages use SharedArrayBuffer, which
+		// WebAssembly threads need. Isolated pages from any site are also
+		// allowed to use whatever is served.
+		if config.CrossOriginIsolated {
+			w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+			w.Header().Set("Cross-Origin-Embedder-Policy", "require-corp")
+			w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+		}
+
 		// Clean up the request path
 		reqPath := r.URL.Path
 		if !strings.HasPrefix(reqPath, "/") {
@@ -642,9 +2940,56 @@ func NewMainHandler(filesystem http.FileSystem) http.Handler {
 		}
 		reqPath = path.Clean(reqPath)
 
+		// Add headers from the security preset and the configuration file.
+		// Headers set for the path take priority.
+		for name, value := range securityHeaderPresets[config.SecurityHeaders] {
+			w.Header().Set(name, value)
+		}
+		SetRouteHeaders(w, reqPath)
+
+		info, err := os.Stat(filepath.FromSlash("." + reqPath))
+		if IsHiddenPath(reqPath) || IsIgnoredPath(reqPath, err == nil && info.IsDir()) {
+			logger.Printf("Not serving hidden or ignored path %v\n", reqPath)
+			http.NotFound(w, r)
+			return
+		}
+
 		// Open the path in the filesystem for further inspection
+		requestPath := reqPath
 		f, err := filesystem.Open(reqPath)
+		cleanURL := false
+		if err != nil && config.CleanURLs {
+			// Look for a file to use for the path without its extension, like
+			// about.html for /about, and act like it was requested instead
+			if file, found := FindCleanURLFile(reqPath, r.Method); found {
+				cleanURL = true
+				reqPath = file
+				r.URL.Path, r.URL.RawPath = file, ""
+				f, err = filesystem.Open(reqPath)
+			}
+		}
 		if err != nil {
+			// If the path doesn't exist, look for handlers specific to the
+			// request method, for files and folders like [id] that match
+			// parts of the path, or for an executable file partway through
+			// the path
+			segments := strings.Split(strings.Trim(reqPath, "/"), "/")
+			if route, allowed := FindDynamicRoute("/", segments, r.Method, nil); route.Path != "" {
+				SetRouteHeaders(w, reqPath, route.Path)
+				ServeExecutable(route, allowed, w, r)
+				return
+			} else if len(allowed) > 0 {
+				ServeMethodNotAllowed(w, r, allowed)
+				return
+			}
+
+			// In single-page app mode, serve the nearest index.html instead of
+			// an error, unless there is a default version of the file
+			if config.SPA && (r.Method == "GET" || r.Method == "HEAD") &&
+				ServeAppIndex(filesystem, reqPath, w, r) {
+				return
+			}
+
 			// If we can't open the file, try to serve a default version or let
 			// the FileServer handle it correctly
 			ServeStaticFile(fileserver, reqPath, w, r)
@@ -659,13 +3004,69 @@ func NewMainHandler(filesystem http.FileSystem) http.Handler {
 			return
 		}
 
+		// Redirect paths like /about.html to /about if the user wants, as long
+		// as /about would get the same file
+		if ext := path.Ext(reqPath); config.CleanURLs && config.CleanURLRedirect && !cleanURL &&
+			(r.Method == "GET" || r.Method == "HEAD") && !d.IsDir() && IsCleanURLExtension(ext) {
+			clean := strings.TrimSuffix(reqPath, ext)
+			if file, found := FindCleanURLFile(clean, r.Method); found && file == reqPath && path.Base(clean) != "index" {
+				if existing, err := filesystem.Open(clean); err == nil {
+					existing.Close()
+				} else {
+					if r.URL.RawQuery != "" {
+						clean += "?" + r.URL.RawQuery
+					}
+					http.Redirect(w, r, clean, http.StatusMovedPermanently)
+					return
+				}
+			}
+		}
+
 		// If the path is a directory, look for an index file. If none found,
-		// serve up the directory. Otherwise, act like the executable was the
-		// original requested path.
+		// serve up the directory, unless there are only index files for other
+		// methods. Otherwise, act like the executable was the original
+		// requested path.
+		allowed := HandlerMethods(path.Base(reqPath))
 		if d.IsDir() {
-			index, found := FindIndexFile(reqPath)
+			allowed = executableMethods
+			index, found := FindIndexFile(reqPath, r.Method)
+			_, methods := FindMethodHandler(reqPath, "index", r.Method)
+			hasIndex := false
+			for _, file := range ReadDir(reqPath) {
+				hasIndex = hasIndex || (!file.IsDir() && file.Name() == "index.html")
+			}
+			if hasIndex && len(methods) > 0 {
+				// A static index.html also handles GET and HEAD requests
+				handled := methods
+				methods = nil
+				for _, m := range executableMethods {
+					if m == "GET" || m == "HEAD" || AllowsMethod(handled, m) {
+						methods = append(methods, m)
+					}
+				}
+			}
+			if _, generic := FindIndexFile(reqPath, ""); !generic && len(methods) > 0 {
+				allowed = methods
+			}
 			if !found {
-				fileserver.ServeHTTP(w, r)
+				// Only list folders without any index files, so that index
+				// files for other methods aren't shown
+				if len(methods) > 0 && !(hasIndex && (r.Method == "GET" || r.Method == "HEAD")) {
+					ServeMethodNotAllowed(w, r, methods)
+					return
+				}
+				if strings.HasSuffix(r.URL.Path, "/") && !hasIndex && config.NoListing {
+					http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				} else if strings.HasSuffix(r.URL.Path, "/") && !hasIndex {
+					ServeDirectoryListing(reqPath, w, r)
+				} else {
+					// Let the FileServer serve index.html, or redirect to the
+					// path with a trailing slash
+					if hasIndex && strings.HasSuffix(r.URL.Path, "/") {
+						SetRouteHeaders(w, requestPath, path.Join(reqPath, "index.html"))
+					}
+					fileserver.ServeHTTP(w, r)
+				}
 				return
 			} else {
 				reqPath = index
@@ -687,10 +3088,26 @@ func NewMainHandler(filesystem http.FileSystem) http.Handler {
 			}
 		}
 
+		// Settings for the file that was found apply along with settings for
+		// the requested path
+		SetRouteHeaders(w, requestPath, reqPath)
+
 		if IsPathExecutable(reqPath, d) {
-			// If the path is executable, run it
-			ExecutePath(r.Context(), reqPath, w, r)
-		} else {
+			// If the path is executable, run it. Files for a specific method,
+			// like users.post.py, only run for that method, even when they
+			// are requested by name.
+			if !AllowsMethod(allowed, r.Method) {
+				ServeMethodNotAllowed(w, r, allowed)
+				return
+			}
+			ServeExecutable(Route{Path: reqPath}, allowed, w, r)
+			return
+		}
+
+		if !(config.Compress && ServePrecompressed(filesystem, reqPath, w, r)) {
+			// The FileServer handles If-None-Match requests once there is an
+			// ETag
+			w.Header().Set("ETag", StaticETag(d))
 			fileserver.ServeHTTP(w, r)
 		}
 	})
@@ -701,15 +3118,45 @@ func NewMainHandler(filesystem http.FileSystem) http.Handler {
  *****************************************************************************/
 
 func init() {
-	// Parse command line arguments
+	// Define command line arguments. They are parsed in main so that tests
+	// can use their own flags.
 	flag.StringVar(&logfileName, "logfile", "-", "Log file path. Stdout if unspecified.")
 	flag.StringVar(&wd, "dir", ".", "Folder to serve files from.")
 	flag.BoolVar(&randomPort, "random-port", false, "Use a random port instead of 42069.")
 	flag.BoolVar(&noPause, "no-pause", false, "Don't pause before exiting after fatal error.")
-	flag.Parse()
+	flag.StringVar(&configName, "config", "", "Configuration file path, relative to the folder being served. Uses quickserv.json if it exists and this is unspecified.")
+	flag.BoolVar(&config.NoHeadExec, "no-head-exec", false, "Don't run scripts for HEAD requests.")
+	flag.BoolVar(&config.JSONArgs, "json-args", false, "Pass fields of JSON objects sent to scripts as arguments.")
+	flag.BoolVar(&config.SaveUploads, "save-uploads", false, "Save uploaded files and pass their paths to scripts.")
+	flag.Int64Var(&config.MaxUploadMB, "max-upload-mb", 100, "Maximum upload size in megabytes when saving uploads. 0 for no limit.")
+	flag.StringVar(&config.ArgStyle, "arg-style", ArgStyleGNU, "How to pass form variables to scripts: gnu, key-value, positional, env, or json.")
+	flag.Int64Var(&config.MaxBodyMB, "max-body-mb", 0, "Maximum request body size in megabytes for scripts. 0 for no limit.")
+	config.BodyTimeout = Duration(30 * time.Second)
+	flag.Var(&config.BodyTimeout, "body-timeout", "Give up on request bodies if no data arrives for this long. 0 for no limit.")
+	config.ReadHeaderTimeout = Duration(10 * time.Second)
+	flag.Var(&config.ReadHeaderTimeout, "read-header-timeout", "Maximum time to read request headers. 0 for no limit.")
+	flag.Var(&config.ReadTimeout, "read-timeout", "Maximum time to read a whole request, except request bodies sent to scripts, which use the body timeout. 0 for no limit.")
+	flag.Var(&config.WriteTimeout, "write-timeout", "Maximum time to send a response, not counting the time scripts take to run. 0 for no limit.")
+	config.IdleTimeout = Duration(2 * time.Minute)
+	flag.Var(&config.IdleTimeout, "idle-timeout", "Close connections that have no requests for this long. 0 for no limit.")
+	flag.IntVar(&config.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers in bytes.")
+	flag.BoolVar(&config.Compress, "compress", false, "Compress responses, and serve precompressed .gz, .br, and .zst files.")
+	flag.IntVar(&config.CompressMinBytes, "compress-min-bytes", 1024, "Don't compress responses smaller than this many bytes.")
+	flag.Var(&config.CacheTTL, "cache-ttl", "Reuse script output for identical requests for this long. 0 to always run scripts.")
+	flag.StringVar(&config.CacheControl, "cache-control", "", "Cache-Control header to send with responses, such as \"no-cache\" or \"max-age=60\".")
+	flag.BoolVar(&config.NoListing, "no-listing", false, "Don't list the files in folders that have no index file.")
+	flag.BoolVar(&config.AllowDotfiles, "allow-dotfiles", false, "Serve and run files and folders with names starting with a dot, such as .env and .git.")
+	flag.StringVar(&config.SecurityHeaders, "security-headers", "", "Add security headers to every response: basic, or isolated to also enable cross-origin isolation.")
+	flag.BoolVar(&config.CrossOriginIsolated, "cross-origin-isolated", false, "Enable cross-origin isolation, which pages need to use SharedArrayBuffer and WebAssembly threads.")
+	flag.BoolVar(&config.SPA, "spa", false, "Single-page app mode: serve the nearest index.html for paths that don't exist.")
+	flag.BoolVar(&config.CleanURLs, "clean-urls", false, "Serve files like about.html and about.py for paths without file extensions, like /about.")
+	flag.BoolVar(&config.CleanURLRedirect, "clean-url-redirect", false, "With clean URLs, redirect paths like /about.html to /about.")
+	config.CleanURLExtensions = []string{".html"}
+	flag.StringVar(&config.Symlinks, "symlinks", SymlinksWithinRoot, "How to handle symbolic links: follow, follow-within-root, or deny.")
 }
 
 func main() {
+	flag.Parse()
 	logger = NewLogFile(logfileName)
 
 	// Switch directories and print the current working directory
@@ -722,6 +3169,23 @@ func main() {
 		Fatal(err)
 	}
 	fmt.Printf("Running in folder:\n%v\n\n", wd)
+	rootDir = wd
+
+	// Load the configuration file from the folder if there is one
+	if configName != "" {
+		err = LoadConfig(configName, true)
+	} else {
+		err = LoadConfig("quickserv.json", false)
+	}
+	if err == nil {
+		err = CheckConfig(config)
+	}
+	if err != nil {
+		Fatal(err)
+	}
+	if config.SecurityHeaders == "isolated" {
+		config.CrossOriginIsolated = true
+	}
 
 	// Print non-static routes that will be executed (if any)
 	routes, err := FindExecutablePaths(logfileName)
@@ -759,11 +3223,34 @@ https://github.com/jstrieb/quickserv`)
 	fmt.Printf("Visit http://%v:%v to access the server from the local network.\n", localIP, port)
 	fmt.Print("Press Control + C or close this window to stop the server.\n\n")
 
+	// Make sure files are sent with the same types on every operating system,
+	// and with the types the user wants
+	for _, types := range []map[string]string{extensionTypes, config.MimeTypes} {
+		for ext, contentType := range types {
+			if err := mime.AddExtensionType(ext, contentType); err != nil {
+				Fatal(err)
+			}
+		}
+	}
+
 	// Build a handler that decides whether to serve static files or dynamically
 	// execute them
-	handler := NewMainHandler(http.Dir("."))
-	addr := ":" + strconv.FormatInt(port, 10)
-	if err = http.ListenAndServe(addr, handler); err != nil {
+	handler := NewMainHandler(SafeDir("."))
+	server := &http.Server{
+		Addr:              ":" + strconv.FormatInt(port, 10),
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(config.ReadTimeout),
+		WriteTimeout:      time.Duration(config.WriteTimeout),
+		IdleTimeout:       time.Duration(config.IdleTimeout),
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		// Keep track of the connection for each request so that deadlines can
+		// be set while reading request bodies
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
+	if err = server.ListenAndServe(); err != nil {
 		logger.Println("Make sure you are only running one instance of QuickServ!")
 		Fatal(err)
 	}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// enterTempRoot makes a temporary folder the folder being served, like main
+// does with the --dir flag, and changes back once the test is done. Settings
+// changed by the test are also put back.
+func enterTempRoot(t *testing.T) string {
+	t.Helper()
+	saved := config
+	oldWd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(oldWd)
+		config = saved
+	})
+	rootDir, err = os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rootDir
+}
+
+// writeFile creates a file, along with any folders it is in.
+func writeFile(t *testing.T, name, contents string, perm os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(contents), perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetFormAsArguments(t *testing.T) {
+	tests := []struct {
+		form []FormField
+		want []string
+	}{
+		{[]FormField{{"name", "value"}, {"n", "val"}, {"noval", ""}}, []string{"--name", "value", "-n", "val", "noval"}},
+		{[]FormField{{"", "value"}}, []string{"value"}},
+		{[]FormField{{"--name", "value"}, {"-rf", ""}}, []string{"--name", "value", "rf"}},
+		{[]FormField{{"--", "value"}, {"-", "--evil"}}, nil},
+		{[]FormField{{"", "--evil"}, {"", "-x"}, {"", "ok"}}, []string{"ok"}},
+		{[]FormField{{"name", "--value"}}, []string{"--name", "--value"}},
+	}
+	for _, test := range tests {
+		if got := GetFormAsArguments(test.form); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GetFormAsArguments(%v) = %q, want %q", test.form, got, test.want)
+		}
+	}
+}
+
+func TestGetArguments(t *testing.T) {
+	tests := []struct {
+		style string
+		form  []FormField
+		want  []string
+	}{
+		{ArgStyleKeyValue, []FormField{{"name", "value"}, {"n", "val"}, {"noval", ""}}, []string{"name=value", "n=val", "noval"}},
+		{ArgStyleKeyValue, []FormField{{"--name", "--value"}, {"-rf", ""}}, []string{"name=--value", "rf"}},
+		{ArgStyleKeyValue, []FormField{{"", "--help"}, {"--", "x"}, {"", "ok"}}, []string{"ok"}},
+		{ArgStylePositional, []FormField{{"name", "value"}, {"n", "val"}, {"noval", ""}}, []string{"value", "val", ""}},
+		{ArgStylePositional, []FormField{{"a", "value"}, {"b", "--help"}, {"c", "-x"}}, []string{"--", "value", "--help", "-x"}},
+		{ArgStylePositional, []FormField{{"", "--"}}, []string{"--", "--"}},
+		{ArgStyleGNU, []FormField{{"", "--evil"}, {"n", "val"}}, []string{"-n", "val"}},
+		{ArgStyleEnv, []FormField{{"name", "value"}}, nil},
+		{ArgStyleJSON, []FormField{{"name", "value"}}, nil},
+	}
+	for _, test := range tests {
+		if got := GetArguments(test.form, test.style); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GetArguments(%v, %v) = %q, want %q", test.form, test.style, got, test.want)
+		}
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	enterTempRoot(t)
+	writeFile(t, filepath.Join(outside, "secret.txt"), "secret", 0644)
+	writeFile(t, filepath.Join(outside, "run.sh"), "#!/bin/sh\necho outside\n", 0755)
+	writeFile(t, "page.txt", "page", 0644)
+	writeFile(t, "inside.sh", "#!/bin/sh\necho inside\n", 0755)
+	links := map[string]string{
+		"out.txt": filepath.Join(outside, "secret.txt"),
+		"out.sh":  filepath.Join(outside, "run.sh"),
+		"outdir":  outside,
+		"in.txt":  "page.txt",
+		"in.sh":   "inside.sh",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			t.Skipf("can't make symbolic links: %v", err)
+		}
+	}
+
+	tests := []struct {
+		policy, name string
+		allowed      bool
+	}{
+		{SymlinksWithinRoot, "page.txt", true},
+		{SymlinksWithinRoot, "in.txt", true},
+		{SymlinksWithinRoot, "out.txt", false},
+		{SymlinksWithinRoot, "outdir/secret.txt", false},
+		{SymlinksDeny, "page.txt", true},
+		{SymlinksDeny, "in.txt", false},
+		{SymlinksDeny, "out.txt", false},
+		{SymlinksDeny, "outdir/secret.txt", false},
+		{SymlinksFollow, "out.txt", true},
+		{SymlinksFollow, "outdir/secret.txt", true},
+	}
+	for _, test := range tests {
+		config.Symlinks = test.policy
+		if err := CheckSymlinks(filepath.FromSlash(test.name)); (err == nil) != test.allowed {
+			t.Errorf("CheckSymlinks(%q) with %v = %v, want allowed %v", test.name, test.policy, err, test.allowed)
+		}
+		f, err := SafeDir(".").Open("/" + test.name)
+		if err == nil {
+			f.Close()
+		} else if !os.IsNotExist(err) {
+			t.Errorf("SafeDir.Open(%q) with %v = %v, want a not exist error", test.name, test.policy, err)
+		}
+		if (err == nil) != test.allowed {
+			t.Errorf("SafeDir.Open(%q) with %v = %v, want allowed %v", test.name, test.policy, err, test.allowed)
+		}
+	}
+
+	execTests := []struct {
+		policy, name string
+		code         int
+		body         string
+	}{
+		{SymlinksWithinRoot, "/inside.sh", 200, "inside\n"},
+		{SymlinksWithinRoot, "/in.sh", 200, "inside\n"},
+		{SymlinksWithinRoot, "/out.sh", 404, ""},
+		{SymlinksWithinRoot, "/outdir/run.sh", 404, ""},
+		{SymlinksDeny, "/inside.sh", 200, "inside\n"},
+		{SymlinksDeny, "/in.sh", 404, ""},
+		{SymlinksDeny, "/out.sh", 404, ""},
+	}
+	for _, test := range execTests {
+		config.Symlinks = test.policy
+		r := httptest.NewRequest("GET", test.name, nil)
+		w := httptest.NewRecorder()
+		ExecutePath(r.Context(), Route{Path: test.name}, w, r)
+		if w.Code != test.code {
+			t.Errorf("ExecutePath(%q) with %v gave status %v, want %v", test.name, test.policy, w.Code, test.code)
+		}
+		if body := w.Body.String(); test.code == http.StatusOK && body != test.body {
+			t.Errorf("ExecutePath(%q) with %v gave %q, want %q", test.name, test.policy, body, test.body)
+		} else if strings.Contains(body, "outside") {
+			t.Errorf("ExecutePath(%q) with %v ran a program outside of the root", test.name, test.policy)
+		}
+	}
+}
+
+func TestIgnorePatternToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		anchored bool
+		path     string
+		match    bool
+	}{
+		{"*.log", false, "a.log", true},
+		{"*.log", false, "logs/a.log", true},
+		{"*.log", false, "a.logs", false},
+		{"build", true, "build", true},
+		{"build", true, "src/build", false},
+		{"docs/*.md", true, "docs/a.md", true},
+		{"docs/*.md", true, "docs/old/a.md", false},
+		{"docs/*.md", true, "src/docs/a.md", false},
+		{"**/temp", true, "temp", true},
+		{"**/temp", true, "a/b/temp", true},
+		{"logs/**", true, "logs/a/b.txt", true},
+		{"logs/**", true, "logs", false},
+		{"a/**/b", true, "a/b", true},
+		{"a/**/b", true, "a/x/y/b", true},
+		{"?.txt", false, "a.txt", true},
+		{"?.txt", false, "ab.txt", false},
+		{"[!a]b", false, "cb", true},
+		{"[!a]b", false, "ab", false},
+		{`\*`, false, "*", true},
+		{`\*`, false, "x", false},
+	}
+	for _, test := range tests {
+		re, err := IgnorePatternToRegexp(test.pattern, test.anchored)
+		if err != nil {
+			t.Errorf("IgnorePatternToRegexp(%q, %v) gave error %v", test.pattern, test.anchored, err)
+			continue
+		}
+		if got := re.MatchString(test.path); got != test.match {
+			t.Errorf("IgnorePatternToRegexp(%q, %v) matching %q = %v, want %v", test.pattern, test.anchored, test.path, got, test.match)
+		}
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	type rule struct {
+		pattern         string
+		negate, dirOnly bool
+	}
+	want := []rule{
+		{`^(?:.*/)?[^/]*\.log$`, false, false},
+		{`^(?:.*/)?keep\.log$`, true, false},
+		{`^(?:.*/)?build$`, false, true},
+		{`^top$`, false, false},
+		{`^a/b$`, false, false},
+		{`^old$`, true, true},
+	}
+	data := "# Comment\n\n*.log\n!keep.log\nbuild/\n/top\r\na/b \n!/old/\n/\n"
+	var got []rule
+	for _, r := range ParseIgnoreFile([]byte(data)) {
+		got = append(got, rule{r.Pattern.String(), r.Negate, r.DirOnly})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseIgnoreFile(%q) = %v, want %v", data, got, want)
+	}
+}
+
+func TestIsIgnoredPath(t *testing.T) {
+	enterTempRoot(t)
+	ignoreCache.Lock()
+	ignoreCache.files = make(map[string]ignoreFile)
+	ignoreCache.Unlock()
+	writeFile(t, ".quickservignore", "*.log\n!keep.log\nbuild/\n/secret.txt\n", 0644)
+	writeFile(t, filepath.Join("sub", ".quickservignore"), "!*.log\nsecret.txt\n", 0644)
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"/", true, false},
+		{"/index.html", false, false},
+		{"/a.log", false, true},
+		{"/keep.log", false, false},
+		{"/x/a.log", false, true},
+		{"/sub/a.log", false, false},
+		{"/sub/deeper/a.log", false, false},
+		{"/build", true, true},
+		{"/build", false, false},
+		{"/x/build/file.txt", false, true},
+		{"/build/keep.log", false, true},
+		{"/secret.txt", false, true},
+		{"/x/secret.txt", false, false},
+		{"/sub/secret.txt", false, true},
+		{"/sub/x/secret.txt", false, true},
+	}
+	for _, test := range tests {
+		if got := IsIgnoredPath(test.path, test.isDir); got != test.ignored {
+			t.Errorf("IsIgnoredPath(%q, %v) = %v, want %v", test.path, test.isDir, got, test.ignored)
+		}
+	}
+}
+
+func TestFindDynamicRoute(t *testing.T) {
+	enterTempRoot(t)
+	for _, name := range []string{
+		"api/users/me.sh",
+		"api/users/me/index.sh",
+		"api/users/[id].sh",
+		"api/users/[id]/edit.sh",
+		"api/users/[...rest].sh",
+		"api/items.get.sh",
+		"api/items.post.sh",
+		"api/orders/[id].delete.sh",
+		"api/tools.sh",
+		"docs/[...path]/index.sh",
+		"onlypost/index.post.sh",
+	} {
+		writeFile(t, filepath.FromSlash(name), "#!/bin/sh\n", 0755)
+	}
+
+	all := executableMethods
+	tests := []struct {
+		method, path string
+		route        Route
+		allowed      []string
+	}{
+		{"GET", "/api/users/me.sh", Route{Path: "/api/users/me.sh"}, all},
+		{"GET", "/api/users/me", Route{Path: "/api/users/me/index.sh"}, all},
+		{"GET", "/api/users/42", Route{Path: "/api/users/[id].sh", Params: []Param{{"id", "42"}}}, all},
+		{"GET", "/api/users/42/edit.sh", Route{Path: "/api/users/[id]/edit.sh", Params: []Param{{"id", "42"}}}, all},
+		{"GET", "/api/users/42/x/y", Route{Path: "/api/users/[...rest].sh", Params: []Param{{"rest", "42/x/y"}}}, all},
+		{"GET", "/api/tools.sh/a/b", Route{Path: "/api/tools.sh", PathInfo: "/a/b"}, all},
+		{"GET", "/api/items", Route{Path: "/api/items.get.sh"}, []string{"OPTIONS", "GET", "HEAD", "POST"}},
+		{"HEAD", "/api/items", Route{Path: "/api/items.get.sh"}, []string{"OPTIONS", "GET", "HEAD", "POST"}},
+		{"POST", "/api/items", Route{Path: "/api/items.post.sh"}, []string{"OPTIONS", "GET", "HEAD", "POST"}},
+		{"DELETE", "/api/items", Route{}, []string{"OPTIONS", "GET", "HEAD", "POST"}},
+		{"DELETE", "/api/orders/7", Route{Path: "/api/orders/[id].delete.sh", Params: []Param{{"id", "7"}}}, []string{"OPTIONS", "DELETE"}},
+		{"GET", "/api/orders/7", Route{}, []string{"OPTIONS", "DELETE"}},
+		{"GET", "/docs/a/b", Route{Path: "/docs/[...path]/index.sh", Params: []Param{{"path", "a/b"}}}, all},
+		{"POST", "/onlypost", Route{Path: "/onlypost/index.post.sh"}, []string{"OPTIONS", "POST"}},
+		{"GET", "/onlypost", Route{}, []string{"OPTIONS", "POST"}},
+		{"GET", "/missing/page", Route{}, nil},
+	}
+	for _, test := range tests {
+		segments := strings.Split(strings.Trim(test.path, "/"), "/")
+		route, allowed := FindDynamicRoute("/", segments, test.method, nil)
+		if !reflect.DeepEqual(route, test.route) || !reflect.DeepEqual(allowed, test.allowed) {
+			t.Errorf("FindDynamicRoute(%v %v) = %+v, %v, want %+v, %v",
+				test.method, test.path, route, allowed, test.route, test.allowed)
+		}
+	}
+}
+
+// serve sends a request to the main handler for the current folder, and
+// returns the response.
+func serve(method, target string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	w := httptest.NewRecorder()
+	NewMainHandler(SafeDir(".")).ServeHTTP(w, r)
+	return w
+}
+
+func TestMethodHandlerFiles(t *testing.T) {
+	enterTempRoot(t)
+	writeFile(t, filepath.Join("api", "items.get.sh"), "#!/bin/sh\necho get\n", 0755)
+	writeFile(t, filepath.Join("api", "items.post.sh"), "#!/bin/sh\necho post\n", 0755)
+	writeFile(t, filepath.Join("api", "all.sh"), "#!/bin/sh\necho all\n", 0755)
+	writeFile(t, filepath.Join("form", "index.html"), "form page", 0644)
+	writeFile(t, filepath.Join("form", "index.post.sh"), "#!/bin/sh\necho post\n", 0755)
+
+	tests := []struct {
+		method, path string
+		code         int
+		body, allow  string
+	}{
+		{"GET", "/api/items", 200, "get\n", ""},
+		{"POST", "/api/items", 200, "post\n", ""},
+		{"GET", "/api/items.get.sh", 200, "get\n", ""},
+		{"HEAD", "/api/items.get.sh", 200, "", ""},
+		{"POST", "/api/items.post.sh", 200, "post\n", ""},
+		{"GET", "/api/items.post.sh", 405, "", "OPTIONS, POST"},
+		{"DELETE", "/api/items.get.sh", 405, "", "OPTIONS, GET, HEAD"},
+		{"OPTIONS", "/api/items.post.sh", 204, "", "OPTIONS, POST"},
+		{"GET", "/api/items.post.sh/extra", 405, "", "OPTIONS, POST"},
+		{"DELETE", "/api/all.sh", 200, "all\n", ""},
+		{"GET", "/form/", 200, "form page", ""},
+		{"POST", "/form/", 200, "post\n", ""},
+		{"PUT", "/form/", 405, "", "OPTIONS, GET, HEAD, POST"},
+		{"OPTIONS", "/form/", 204, "", "OPTIONS, GET, HEAD, POST"},
+	}
+	for _, test := range tests {
+		w := serve(test.method, test.path)
+		if w.Code != test.code {
+			t.Errorf("%v %v gave status %v, want %v", test.method, test.path, w.Code, test.code)
+		}
+		if body := w.Body.String(); test.code == http.StatusOK && body != test.body {
+			t.Errorf("%v %v gave %q, want %q", test.method, test.path, body, test.body)
+		} else if test.code != http.StatusOK && (strings.Contains(body, "get\n") || strings.Contains(body, "post\n")) {
+			t.Errorf("%v %v ran a handler for another method: %q", test.method, test.path, body)
+		}
+		if allow := w.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%v %v gave Allow %q, want %q", test.method, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestCleanURLMethodHandlers(t *testing.T) {
+	enterTempRoot(t)
+	config.CleanURLs = true
+	writeFile(t, "contact.html", "contact page", 0644)
+	writeFile(t, "contact.post.sh", "#!/bin/sh\necho post\n", 0755)
+	writeFile(t, "echo.html", "echo page", 0644)
+	writeFile(t, "echo.sh", "#!/bin/sh\necho echo\n", 0755)
+	writeFile(t, "page.html", "static page", 0644)
+	writeFile(t, "page.get.sh", "#!/bin/sh\necho get\n", 0755)
+	writeFile(t, "run.sh", "#!/bin/sh\necho run\n", 0755)
+
+	tests := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", "/contact", 200, "contact page"},
+		{"HEAD", "/contact", 200, ""},
+		{"POST", "/contact", 200, "post\n"},
+		{"PUT", "/contact", 405, ""},
+		{"GET", "/echo", 200, "echo page"},
+		{"POST", "/echo", 200, "echo\n"},
+		{"GET", "/page", 200, "get\n"},
+		{"GET", "/run", 200, "run\n"},
+	}
+	for _, test := range tests {
+		w := serve(test.method, test.path)
+		if w.Code != test.code {
+			t.Errorf("%v %v gave status %v, want %v", test.method, test.path, w.Code, test.code)
+		}
+		if body := w.Body.String(); test.code == http.StatusOK && body != test.body {
+			t.Errorf("%v %v gave %q, want %q", test.method, test.path, body, test.body)
+		}
+	}
+
+	routes, err := FindExecutablePaths("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"POST /contact": "/contact.post.sh",
+		"/echo.sh":      "",
+		"GET /page":     "/page.get.sh",
+		"/run":          "/run.sh",
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("FindExecutablePaths() = %v, want %v", routes, want)
+	}
+}
+
+func TestErrorPageSideEffects(t *testing.T) {
+	enterTempRoot(t)
+	config.NoHeadExec = true
+	writeFile(t, "404.sh", "#!/bin/sh\ntouch ran\necho missing\n", 0755)
+
+	for _, method := range []string{"OPTIONS", "HEAD", "GET"} {
+		w := serve(method, "/missing")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%v /missing gave status %v, want 404", method, w.Code)
+		}
+		_, err := os.Stat("ran")
+		if ran := err == nil; ran != (method == "GET") {
+			t.Errorf("%v /missing ran the error page: %v, want %v", method, ran, method == "GET")
+		}
+	}
+}
+
+func TestConfigFileHidden(t *testing.T) {
+	enterTempRoot(t)
+	t.Cleanup(func() { configPath = "" })
+	writeFile(t, "quickserv.json", `{"cache_control": "no-cache"}`, 0644)
+	writeFile(t, "page.txt", "page", 0644)
+	if err := LoadConfig("quickserv.json", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve("GET", "/quickserv.json"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /quickserv.json gave status %v, want 404", w.Code)
+	}
+	if w := serve("GET", "/page.txt"); w.Code != http.StatusOK {
+		t.Errorf("GET /page.txt gave status %v, want 200", w.Code)
+	}
+	if w := serve("GET", "/"); !strings.Contains(w.Body.String(), "page.txt") ||
+		strings.Contains(w.Body.String(), "quickserv.json") {
+		t.Errorf("GET / listed the configuration file: %q", w.Body.String())
+	}
+	for _, file := range ReadDir("/") {
+		if file.Name() == "quickserv.json" {
+			t.Errorf("ReadDir(%q) included the configuration file", "/")
+		}
+	}
+}
+
+func TestGetOutputType(t *testing.T) {
+	tests := []struct {
+		name, configured, output string
+		contentType              string
+		declared                 bool
+	}{
+		{"data.json.sh", "", "not json", "application/json", true},
+		{"data.json.get.sh", "", "not json", "application/json", true},
+		{"data.json.post", "", "not json", "application/json", true},
+		{"feed.xml.get.py", "", "text", "text/xml; charset=utf-8", true},
+		{"data.get.sh", "", "text", "text/plain; charset=utf-8", false},
+		{"data.sh", "", `{"a": 1}`, "application/json", false},
+		{"data.json.sh", "text/csv", "a,b", "text/csv", true},
+	}
+	for _, test := range tests {
+		contentType, declared, err := GetOutputType("/"+test.name, test.configured, strings.NewReader(test.output))
+		if err != nil || contentType != test.contentType || declared != test.declared {
+			t.Errorf("GetOutputType(%q, %q) = %q, %v, %v, want %q, %v", test.name, test.configured,
+				contentType, declared, err, test.contentType, test.declared)
+		}
+	}
+}